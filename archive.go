@@ -0,0 +1,329 @@
+package fstash
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive formats
+const (
+	FormatTarGz = "tar.gz"
+	FormatZip   = "zip"
+)
+
+// ArchiveFormat guesses the format of an archive from its file name.
+func ArchiveFormat(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		return FormatZip
+	}
+	return FormatTarGz
+}
+
+// archiveWriter writes files and symlinks into an archive.
+type archiveWriter interface {
+	writeFile(name string, mode os.FileMode, content []byte) error
+	writeSymlink(name, target string) error
+	Close() error
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}, nil
+	case FormatZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzWriter) writeFile(name string, mode os.FileMode, content []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode.Perm()),
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(content)
+	return err
+}
+
+func (a *tarGzWriter) writeSymlink(name, target string) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  time.Now(),
+	})
+}
+
+func (a *tarGzWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipWriter) writeFile(name string, mode os.FileMode, content []byte) error {
+	return a.write(name, mode.Perm(), content)
+}
+
+func (a *zipWriter) writeSymlink(name, target string) error {
+	return a.write(name, os.ModeSymlink|0777, []byte(target))
+}
+
+func (a *zipWriter) write(name string, mode os.FileMode, content []byte) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+	hdr.SetMode(mode)
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+func (a *zipWriter) Close() error {
+	return a.zw.Close()
+}
+
+// archiveEntry is a file or a symlink read from an archive, or kept in a
+// store.
+type archiveEntry struct {
+	mode    os.FileMode
+	content []byte
+	link    string
+}
+
+// newEntry makes an entry of the content and the mode of a key of a store,
+// where a symlink keeps its target as content.
+func newEntry(content []byte, mode os.FileMode) *archiveEntry {
+	if mode&os.ModeSymlink != 0 {
+		return &archiveEntry{mode: os.ModeSymlink | 0777, link: string(content)}
+	}
+	return &archiveEntry{mode: mode.Perm(), content: content}
+}
+
+// isLink tells whether the entry is a symlink.
+func (e *archiveEntry) isLink() bool {
+	return e.mode&os.ModeSymlink != 0
+}
+
+// perm is the mode of a file entry, 0644 when it has none.
+func (e *archiveEntry) perm() os.FileMode {
+	if mode := e.mode.Perm(); mode != 0 {
+		return mode
+	}
+	return 0644
+}
+
+// readArchive reads all the files and symlinks of a tar.gz, tar or zip
+// archive, by their cleaned slash separated names.
+func readArchive(content []byte) (map[string]*archiveEntry, error) {
+	switch {
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")), bytes.HasPrefix(content, []byte("PK\x05\x06")):
+		return readZip(content)
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return readTar(gz)
+	}
+	return readTar(bytes.NewReader(content))
+}
+
+func readTar(r io.Reader) (map[string]*archiveEntry, error) {
+	entries := make(map[string]*archiveEntry)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry *archiveEntry
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			entry = &archiveEntry{mode: os.FileMode(hdr.Mode).Perm(), content: content}
+		case tar.TypeSymlink:
+			entry = &archiveEntry{mode: os.ModeSymlink | 0777, link: hdr.Linkname}
+		default:
+			continue
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		entries[name] = entry
+	}
+}
+
+func readZip(content []byte) (map[string]*archiveEntry, error) {
+	// newer versions of Go report insecure names along with a usable reader,
+	// those names are refused by cleanEntryName
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if zr == nil {
+		return nil, err
+	}
+	entries := make(map[string]*archiveEntry)
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		name, err := cleanEntryName(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if mode&os.ModeSymlink != 0 {
+			entries[name] = &archiveEntry{mode: os.ModeSymlink | 0777, link: string(content)}
+			continue
+		}
+		entries[name] = &archiveEntry{mode: mode.Perm(), content: content}
+	}
+	return entries, nil
+}
+
+// cleanEntryName refuses names that would end up outside of the directory
+// the archive is extracted into.
+func cleanEntryName(name string) (string, error) {
+	name = path.Clean(strings.Replace(name, `\`, "/", -1))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || name == "." {
+		return "", fmt.Errorf("%s: %w", name, ErrInvalidArchive)
+	}
+	return name, nil
+}
+
+// checkEntryName refuses a name cleanEntryName would refuse or change, so a
+// path recorded anywhere can be written inside a directory as it is.
+func checkEntryName(name string) error {
+	clean, err := cleanEntryName(name)
+	if err != nil {
+		return err
+	}
+	if clean != name {
+		return fmt.Errorf("%s: %w", name, ErrInvalidArchive)
+	}
+	return nil
+}
+
+// checkLink refuses a symlink named name, pointing to target, that leads
+// outside of the directory the archive is extracted into.
+func checkLink(name, target string) error {
+	target = strings.Replace(target, `\`, "/", -1)
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return fmt.Errorf("%s: %w", name, ErrInvalidArchive)
+	}
+	resolved := path.Join(path.Dir(name), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("%s: %w", name, ErrInvalidArchive)
+	}
+	return nil
+}
+
+// checkEntries refuses names leading outside of the directory the entries are
+// extracted into, symlinks leading outside of it and entries under a symlink.
+func checkEntries(entries map[string]*archiveEntry) error {
+	for name, entry := range entries {
+		if err := checkEntryName(name); err != nil {
+			return err
+		}
+		if entry.mode&os.ModeSymlink != 0 {
+			if err := checkLink(name, entry.link); err != nil {
+				return err
+			}
+		}
+		for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+			if p, ok := entries[parent]; ok && p.mode&os.ModeSymlink != 0 {
+				return fmt.Errorf("%s: %w", name, ErrInvalidArchive)
+			}
+		}
+	}
+	return nil
+}
+
+// writeEntries writes the entries into dir, see extractEntries. Entries
+// refused by checkEntries are not written at all.
+func writeEntries(entries map[string]*archiveEntry, dir string) error {
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
+	return extractEntries(entries, dir)
+}
+
+// extractEntries writes the entries into dir: the files first and then the
+// symlinks, so nothing is ever written through a symlink.
+func extractEntries(entries map[string]*archiveEntry, dir string) error {
+	var files, links []string
+	for name, entry := range entries {
+		if entry.isLink() {
+			links = append(links, name)
+		} else {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(links)
+
+	for _, name := range files {
+		fp := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+			return err
+		}
+		if err := writeFileMode(fp, entries[name].content, entries[name].perm()); err != nil {
+			return err
+		}
+	}
+	for _, name := range links {
+		fp := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+			return err
+		}
+		if err := writeSymlink(fp, entries[name].link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
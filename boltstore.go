@@ -0,0 +1,295 @@
+package fstash
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltFile is the database of the bolt store, inside fstash home.
+const boltFile = "fstash.db"
+
+// Buckets of the bolt store. Stashes and versions hold a nested bucket for
+// each stash, with its files by path and its versions in order.
+var (
+	bucketStashes   = []byte("stashes")
+	bucketManifests = []byte("manifests")
+	bucketVersions  = []byte("versions")
+	bucketBlobs     = []byte("blobs")
+)
+
+// boltStore keeps everything in a single bbolt database file. Manifests are
+// kept without their versions, which go to the versions bucket.
+type boltStore struct {
+	db *bolt.DB
+	// tx is the transaction of a batch
+	tx *bolt.Tx
+}
+
+func openBoltStore(fp string) (*boltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(fp, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketStashes, bucketManifests, bucketVersions, bucketBlobs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Batch runs fn with a store making all its changes in one transaction. A
+// batch inside a batch joins its transaction.
+func (s *boltStore) Batch(fn func(Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltStore{db: s.db, tx: tx})
+	})
+}
+
+func (s *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.Update(fn)
+}
+
+func (s *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.View(fn)
+}
+
+func (s *boltStore) Put(key string, content []byte, mode os.FileMode) error {
+	kind, name, rel, err := parseKey(key)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		switch kind {
+		case keyBlob:
+			return tx.Bucket(bucketBlobs).Put([]byte(name), content)
+		case keyManifest:
+			m := &Manifest{}
+			if err := json.Unmarshal(content, m); err != nil {
+				return err
+			}
+			versions := tx.Bucket(bucketVersions)
+			if err := versions.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			b, err := versions.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for i, v := range m.Versions {
+				content, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(sequenceKey(i), content); err != nil {
+					return err
+				}
+			}
+			m.Versions = nil
+			content, err = json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			return tx.Bucket(bucketManifests).Put([]byte(name), content)
+		}
+		b, err := tx.Bucket(bucketStashes).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		value := make([]byte, 4+len(content))
+		binary.BigEndian.PutUint32(value, uint32(mode))
+		copy(value[4:], content)
+		return b.Put([]byte(rel), value)
+	})
+}
+
+func (s *boltStore) Get(key string) ([]byte, os.FileMode, error) {
+	kind, name, rel, err := parseKey(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	var content []byte
+	mode := os.FileMode(0644)
+	err = s.view(func(tx *bolt.Tx) error {
+		switch kind {
+		case keyBlob:
+			v := tx.Bucket(bucketBlobs).Get([]byte(name))
+			if v == nil {
+				return ErrKeyNotExist
+			}
+			content = append([]byte(nil), v...)
+			return nil
+		case keyManifest:
+			v := tx.Bucket(bucketManifests).Get([]byte(name))
+			if v == nil {
+				return ErrKeyNotExist
+			}
+			m := &Manifest{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return err
+			}
+			if b := tx.Bucket(bucketVersions).Bucket([]byte(name)); b != nil {
+				err := b.ForEach(func(_, v []byte) error {
+					var sv Version
+					if err := json.Unmarshal(v, &sv); err != nil {
+						return err
+					}
+					m.Versions = append(m.Versions, sv)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			var err error
+			content, err = json.MarshalIndent(m, "", "  ")
+			return err
+		}
+		b := tx.Bucket(bucketStashes).Bucket([]byte(name))
+		if b == nil {
+			return ErrKeyNotExist
+		}
+		v := b.Get([]byte(rel))
+		if v == nil {
+			return ErrKeyNotExist
+		}
+		mode = os.FileMode(binary.BigEndian.Uint32(v))
+		content = append([]byte(nil), v[4:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, mode, nil
+}
+
+func (s *boltStore) Stat(key string) (os.FileMode, error) {
+	_, mode, err := s.Get(key)
+	return mode, err
+}
+
+// List reads only the buckets, or the stash, a prefix is limited to.
+func (s *boltStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.view(func(tx *bolt.Tx) error {
+		if overlaps(prefix, archiveBlobs+"/") {
+			err := tx.Bucket(bucketBlobs).ForEach(func(k, _ []byte) error {
+				keys = append(keys, path.Join(archiveBlobs, string(k)))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		stashes, manifests := tx.Bucket(bucketStashes), tx.Bucket(bucketManifests)
+		listStash := func(name []byte) error {
+			if manifests.Get(name) != nil {
+				keys = append(keys, manifestKey(string(name)))
+			}
+			b := stashes.Bucket(name)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, _ []byte) error {
+				keys = append(keys, contentKey(string(name), string(k)))
+				return nil
+			})
+		}
+		if parts := strings.SplitN(prefix, "/", 3); len(parts) == 3 && parts[0] == archiveStashes {
+			return listStash([]byte(parts[1]))
+		}
+		if !overlaps(prefix, archiveStashes+"/") {
+			return nil
+		}
+		names := make(map[string]bool)
+		collect := func(k, _ []byte) error {
+			names[string(k)] = true
+			return nil
+		}
+		if err := manifests.ForEach(collect); err != nil {
+			return err
+		}
+		if err := stashes.ForEach(collect); err != nil {
+			return err
+		}
+		for name := range names {
+			if err := listStash([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filterKeys(keys, prefix), nil
+}
+
+// Delete removes a key. A stash goes with its last file.
+func (s *boltStore) Delete(key string) error {
+	kind, name, rel, err := parseKey(key)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		switch kind {
+		case keyBlob:
+			return tx.Bucket(bucketBlobs).Delete([]byte(name))
+		case keyManifest:
+			err := tx.Bucket(bucketVersions).DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			return tx.Bucket(bucketManifests).Delete([]byte(name))
+		}
+		stashes := tx.Bucket(bucketStashes)
+		b := stashes.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		if err := b.Delete([]byte(rel)); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return stashes.DeleteBucket([]byte(name))
+		}
+		return nil
+	})
+}
+
+// sequenceKey keeps the versions of a stash in their order.
+func sequenceKey(i int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(i))
+	return k
+}
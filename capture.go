@@ -0,0 +1,200 @@
+package fstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// captureOptions holds the settings for capturing files back into a stash.
+type captureOptions struct {
+	// paths are glob patterns of the files to capture
+	paths []string
+	// templatize replaces literal values of the data recorded in the lock file
+	// with the template actions that print them
+	templatize bool
+	// version names the new version of the stash, by default the next number
+	version string
+}
+
+// captureFiles writes files from dir, a directory the stash was expanded
+// into, back into the stash as a new version. Without a stash name, the one
+// in the lock file of dir is used.
+func captureFiles(stashName string, store Store, dir string, opts captureOptions) ([]FileChange, error) {
+	l, err := readLockFile(dir)
+	if err != nil && (err != ErrNoLockFile || stashName == "" || opts.templatize) {
+		return nil, err
+	}
+	if stashName == "" {
+		stashName = l.Stash
+	}
+	m, content, err := openStash(store, stashName)
+	if err != nil {
+		return nil, err
+	}
+	if opts.version != "" {
+		if !validateVersion(opts.version) {
+			return nil, ErrInvalidVersion
+		}
+		if m.findVersion(opts.version) != nil {
+			return nil, ErrVersionExists
+		}
+	}
+
+	// expanded paths to the paths inside the stash
+	stashPaths := make(map[string]string)
+	for rel := range content {
+		stashPaths[strings.TrimSuffix(rel, templateExt)] = rel
+	}
+
+	dirTree, err := readTree(dir, ".git")
+	if err != nil {
+		return nil, err
+	}
+	dirTree = filterTree(dirTree, opts.paths, nil)
+
+	var changes []FileChange
+	captured := make(map[string]*archiveEntry)
+	for path, names := range dirTree {
+		for _, f := range names {
+			rel := filepath.ToSlash(filepath.Join(path, f))
+			if rel == LockFileName {
+				continue
+			}
+			src := filepath.Join(dir, path, f)
+			info, err := os.Stat(src)
+			if err != nil {
+				return nil, err
+			}
+			data, err := ioutil.ReadFile(src)
+			if err != nil {
+				return nil, err
+			}
+			target, ok := stashPaths[rel]
+			if !ok {
+				target = rel
+			}
+			isTemplate := m.isTemplate(target) || strings.HasSuffix(target, templateExt)
+			if !isBinary(data) && (isTemplate || opts.templatize) {
+				var values map[string]interface{}
+				if opts.templatize {
+					if values, err = captureData(l.Data, templateKey(rel)); err != nil {
+						return nil, err
+					}
+				}
+				text, n := templatize(string(data), values)
+				if n > 0 && !isTemplate {
+					m.Templates = append(m.Templates, target)
+					isTemplate = true
+				}
+				if isTemplate {
+					data = []byte(text)
+				}
+			}
+
+			current, ok := content[target]
+			switch {
+			case !ok:
+				changes = append(changes, FileChange{target, "added"})
+			case !current.isLink() && bytes.Equal(current.content, data) && current.perm() == info.Mode().Perm():
+				continue
+			default:
+				changes = append(changes, FileChange{target, "changed"})
+			}
+			captured[target] = &archiveEntry{mode: info.Mode().Perm(), content: data}
+			content[target] = captured[target]
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	sort.Strings(m.Templates)
+
+	return changes, batch(store, func(tx Store) error {
+		if err := putEntries(tx, m.Name, captured); err != nil {
+			return err
+		}
+		if err := snapshotContent(tx, content, m, opts.version); err != nil {
+			return err
+		}
+		return writeManifest(tx, m)
+	})
+}
+
+// captureData is the data of the template key, or all the data merged if
+// there is none for that key.
+func captureData(templatesData map[string]string, key string) (map[string]interface{}, error) {
+	raw := strings.TrimSpace(templatesData[key])
+	if raw == "" {
+		return hookData(templatesData)
+	}
+	data := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// templatize turns content into a template that renders back to content with
+// data: literal {{ are escaped and the string values of data are replaced with
+// the actions printing them, longer values first. Values shorter than three
+// characters are left alone, as they would match too much. It returns the
+// number of replaced values.
+func templatize(content string, data map[string]interface{}) (string, int) {
+	actions := make(map[string]string)
+	identifier := regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	var collect func(prefix string, v map[string]interface{})
+	collect = func(prefix string, v map[string]interface{}) {
+		for k, kv := range v {
+			field := prefix + "." + k
+			if !identifier.MatchString(k) {
+				continue
+			}
+			switch kv := kv.(type) {
+			case string:
+				if len(kv) >= 3 {
+					a, ok := actions[kv]
+					if !ok || len(field) < len(a) || (len(field) == len(a) && field < a) {
+						actions[kv] = field
+					}
+				}
+			case map[string]interface{}:
+				collect(field, kv)
+			}
+		}
+	}
+	collect("", data)
+
+	var values []string
+	for v := range actions {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	alternatives := []string{regexp.QuoteMeta("{{")}
+	for _, v := range values {
+		alternatives = append(alternatives, regexp.QuoteMeta(v))
+	}
+	rx := regexp.MustCompile(strings.Join(alternatives, "|"))
+
+	n := 0
+	result := rx.ReplaceAllStringFunc(content, func(s string) string {
+		if s == "{{" {
+			return `{{"{{"}}`
+		}
+		n++
+		return fmt.Sprintf("{{ %s }}", actions[s])
+	})
+	return result, n
+}
@@ -0,0 +1,759 @@
+package fstash
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Client works on the stashes of an fstash home, kept in the directory layout
+// of the home or in another store. A Client is not safe for concurrent use.
+type Client struct {
+	// home holds the settings, like the remotes, and the stashes of store
+	home string
+	// store holds the stashes of the writable home
+	store    Store
+	homes    []SearchHome
+	project  string
+	config   *Config
+	confirm  func(*Manifest, *Hooks) bool
+	stdout   io.Writer
+	stderr   io.Writer
+	cacheDir string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithConfig applies the defaults of a config: ignore patterns for create, the
+// conflict policy of import, data for templates and more remotes.
+func WithConfig(cfg *Config) Option {
+	return func(c *Client) { c.config = cfg }
+}
+
+// WithStore keeps the stashes of fstash home in a store opened with
+// OpenStore, like a bolt database file, instead of the directory layout of
+// the home. The settings, like the remotes, stay in the home. Closing the
+// store is left to the caller.
+func WithStore(store Store) Option {
+	return func(c *Client) { c.store = store }
+}
+
+// WithSearchPath adds read-only fstash homes, searched in order for the
+// stashes not found in the writable one.
+func WithSearchPath(homes ...SearchHome) Option {
+	return func(c *Client) { c.homes = homes }
+}
+
+// WithProjectHome sets the fstash home of the project, usually found with
+// FindProjectHome. Its stashes come first when looking a name up, and are
+// read-only.
+func WithProjectHome(dir string) Option {
+	return func(c *Client) { c.project = dir }
+}
+
+// WithHookConfirm sets the function asked before running the hooks of a
+// stash that was not created on this machine, given the commands as they
+// will run. Without it those hooks are not run and expanding fails with
+// ErrHooksNotConfirmed.
+func WithHookConfirm(confirm func(*Manifest, *Hooks) bool) Option {
+	return func(c *Client) { c.confirm = confirm }
+}
+
+// WithOutput sets where the output of hooks goes, os.Stdout and os.Stderr by
+// default.
+func WithOutput(stdout, stderr io.Writer) Option {
+	return func(c *Client) { c.stdout, c.stderr = stdout, stderr }
+}
+
+// WithCacheDir sets the directory git repositories and stashes of remotes are
+// fetched into, fstash inside the cache directory of the user by default.
+func WithCacheDir(dir string) Option {
+	return func(c *Client) { c.cacheDir = dir }
+}
+
+// New returns a Client for the fstash home, creating the directory when it
+// does not exist.
+func New(home string, options ...Option) (*Client, error) {
+	if err := os.MkdirAll(home, 0777); err != nil {
+		return nil, &Error{Op: "open", Err: err}
+	}
+	c := &Client{home: home, store: newDirStore(home)}
+	for _, option := range options {
+		option(c)
+	}
+	if c.config == nil {
+		c.config = &Config{}
+	}
+	return c, nil
+}
+
+// Home returns the fstash home of the client.
+func (c *Client) Home() string {
+	return c.home
+}
+
+// Error is returned by the methods of Client. Err is one of the Err values,
+// to be checked with errors.Is, or any other error.
+type Error struct {
+	// Op is the operation that failed, like create or expand
+	Op string
+	// Stash is the name of the stash, if the operation was on one
+	Stash string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Stash == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Stash, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func fail(op, stashName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Stash: stashName, Err: err}
+}
+
+// open returns the store holding the stashes of the writable home.
+func (c *Client) open(ctx context.Context) (Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.store, nil
+}
+
+// save commits the changes when fstash home is a git repository.
+func (c *Client) save(ctx context.Context, message string, stashNames ...string) error {
+	return commitHome(ctx, c.home, c.store, message, stashNames...)
+}
+
+// openWritable is open for a change to the stash ref refers to, which must be
+// in the writable home.
+func (c *Client) openWritable(ctx context.Context, ref string) (Store, string, error) {
+	name, err := writable(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	store, err := c.open(ctx)
+	return store, name, err
+}
+
+func (c *Client) cache(name string) (string, error) {
+	dir := c.cacheDir
+	if dir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(userCache, "fstash")
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// fetch makes sure the cache of the remote holds the stash, at version or the
+// current one, and returns the store of the cache.
+func (c *Client) fetch(ctx context.Context, remoteName, stashName, version string) (Store, error) {
+	r, err := c.findRemote(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	home, err := c.cache(filepath.Join("remotes", remoteName))
+	if err != nil {
+		return nil, err
+	}
+	cache := newDirStore(home)
+	return cache, fetchStash(ctx, stashName, version, cache, r)
+}
+
+// List returns the names of the stashes of the writable home.
+func (c *Client) List(ctx context.Context) ([]string, error) {
+	store, err := c.open(ctx)
+	if err != nil {
+		return nil, fail("list", "", err)
+	}
+	names, err := listStashes(store)
+	return names, fail("list", "", err)
+}
+
+// ListAll returns the stashes of all homes, in the order they are looked up.
+func (c *Client) ListAll(ctx context.Context) ([]StashEntry, error) {
+	if _, err := c.open(ctx); err != nil {
+		return nil, fail("list", "", err)
+	}
+	entries, err := c.listHomes()
+	return entries, fail("list", "", err)
+}
+
+// Search returns the stashes of all homes whose name, description, tags or
+// file paths contain text, ignoring case, in the order they are looked up.
+func (c *Client) Search(ctx context.Context, text string) ([]SearchResult, error) {
+	if _, err := c.open(ctx); err != nil {
+		return nil, fail("search", "", err)
+	}
+	entries, err := c.listHomes()
+	if err != nil {
+		return nil, fail("search", "", err)
+	}
+	homes := make(map[string]SearchHome)
+	for _, h := range c.searchPath() {
+		homes[h.Name] = h
+	}
+	var results []SearchResult
+	for _, e := range entries {
+		r, err := searchStash(c.storeOf(homes[e.Home]), e, text)
+		if err != nil {
+			return nil, fail("search", e.Ref(), err)
+		}
+		if r != nil {
+			results = append(results, *r)
+		}
+	}
+	return results, nil
+}
+
+// SetMeta replaces the description, tags, author and homepage of a stash.
+func (c *Client) SetMeta(ctx context.Context, stashName string, meta Meta) error {
+	store, name, err := c.openWritable(ctx, stashName)
+	if err != nil {
+		return fail("meta", stashName, err)
+	}
+	if err := setMeta(name, store, meta); err != nil {
+		return fail("meta", stashName, err)
+	}
+	return fail("meta", stashName, c.save(ctx, "meta "+name, name))
+}
+
+// Manifest returns the manifest of a stash, given as name or home:name.
+func (c *Client) Manifest(ctx context.Context, stashName string) (*Manifest, error) {
+	if _, err := c.open(ctx); err != nil {
+		return nil, fail("manifest", stashName, err)
+	}
+	h, name, err := c.resolve(stashName)
+	if err != nil {
+		return nil, fail("manifest", stashName, err)
+	}
+	m, _, err := openStash(c.storeOf(h), name)
+	if err != nil {
+		return nil, fail("manifest", stashName, err)
+	}
+	return m, nil
+}
+
+// CreateOptions holds the optional settings of a new stash.
+type CreateOptions struct {
+	// Templates are glob patterns of the files that are templates
+	Templates []string
+	// PreExpand and PostExpand are hook commands
+	PreExpand  []string
+	PostExpand []string
+	// Version names the first version, 1 by default
+	Version string
+	// Ignore are glob patterns of files not to stash, on top of the ones of
+	// the config; update ignores them too
+	Ignore []string
+	// Meta describes the stash; creating it again keeps the fields not set
+	Meta Meta
+}
+
+// Create creates a stash from files and directories, each one given as src
+// or src:dst where dst is its path inside the stash.
+func (c *Client) Create(ctx context.Context, stashName string, sources []string, opts CreateOptions) error {
+	store, name, err := c.openWritable(ctx, stashName)
+	if err != nil {
+		return fail("create", stashName, err)
+	}
+	err = createStashWith(name, sources, store, createOptions{
+		templates:  opts.Templates,
+		preExpand:  opts.PreExpand,
+		postExpand: opts.PostExpand,
+		version:    opts.Version,
+		ignore:     append(append([]string(nil), c.config.Ignore...), opts.Ignore...),
+		meta:       opts.Meta,
+	})
+	if err != nil {
+		return fail("create", stashName, err)
+	}
+	return fail("create", stashName, c.save(ctx, "create "+name, name))
+}
+
+// ExpandOptions holds the optional settings for expanding a stash.
+type ExpandOptions struct {
+	// Data maps template keys, file names without .tmpl, to json data, see
+	// LoadData. It replaces the data of the config field by field.
+	Data map[string]string
+	// Files are the paths inside the stash to expand, all of them if empty
+	Files []string
+	// Only and Exclude are glob patterns selecting what to expand
+	Only, Exclude []string
+	// Lock writes a lock file into the destination, used by Upgrade
+	Lock bool
+	// Secrets are names of data values not to record in the lock file
+	Secrets []string
+	// NoHooks skips running the hooks of the stash
+	NoHooks bool
+}
+
+func (c *Client) expandOptions(opts ExpandOptions) (expandOptions, error) {
+	data, err := c.config.withData(opts.Data)
+	return expandOptions{
+		data:    data,
+		files:   opts.Files,
+		only:    opts.Only,
+		exclude: opts.Exclude,
+		lock:    opts.Lock,
+		secrets: opts.Secrets,
+		noHooks: opts.NoHooks,
+		confirm: c.confirm,
+		stdout:  c.stdout,
+		stderr:  c.stderr,
+	}, err
+}
+
+// Expand expands a stash into dir. The stash is looked up along the search
+// path, unless given as home:name. A name like remote/name[@version] fetches
+// the stash from a remote first.
+func (c *Client) Expand(ctx context.Context, stashName, dir string, opts ExpandOptions) error {
+	if _, err := c.open(ctx); err != nil {
+		return fail("expand", stashName, err)
+	}
+	h, name, err := c.resolve(stashName)
+	if err != nil {
+		return fail("expand", stashName, err)
+	}
+	o, err := c.expandOptions(opts)
+	if err != nil {
+		return fail("expand", stashName, err)
+	}
+	store := c.storeOf(h)
+	o.home, o.readOnly = h.Name, h.Name != LocalHome
+	if remoteName, n, version, ok := parseRemoteRef(stashName); ok {
+		if store, err = c.fetch(ctx, remoteName, n, version); err != nil {
+			return fail("expand", stashName, err)
+		}
+		name = n
+		o.home, o.remote, o.readOnly = "", remoteName, false
+	}
+	return fail("expand", stashName, expandStashWith(name, store, dir, o))
+}
+
+// ExpandGit expands a ref of a git repository, a local path or a URL, into
+// dir, like a stash. Repositories at a URL are mirrored into the cache
+// directory, so they can be expanded again when offline.
+func (c *Client) ExpandGit(ctx context.Context, repo, ref, subdir, dir string, opts ExpandOptions) error {
+	if err := ctx.Err(); err != nil {
+		return fail("expand", repo, err)
+	}
+	cacheDir, err := c.cache("git")
+	if err != nil {
+		return fail("expand", repo, err)
+	}
+	store, name, err := gitStash(ctx, repo, ref, subdir, cacheDir)
+	if err != nil {
+		return fail("expand", repo, err)
+	}
+	o, err := c.expandOptions(opts)
+	if err != nil {
+		return fail("expand", repo, err)
+	}
+	return fail("expand", repo, expandStashWith(name, store, dir, o))
+}
+
+// Update syncs a stash with the files and directories it was created from,
+// as a new version, and returns what changed.
+func (c *Client) Update(ctx context.Context, stashName, version string) ([]FileChange, error) {
+	store, name, err := c.openWritable(ctx, stashName)
+	if err != nil {
+		return nil, fail("update", stashName, err)
+	}
+	changes, err := updateStash(name, store, version)
+	if err != nil {
+		return nil, fail("update", stashName, err)
+	}
+	return changes, fail("update", stashName, c.save(ctx, "update "+name, name))
+}
+
+// InitOptions holds the optional settings for describing a directory.
+type InitOptions struct {
+	// Format is yaml, the default, or json
+	Format string
+	// Force replaces the stash file of the directory
+	Force bool
+}
+
+// Init writes a stash file into dir, listing its files, the ones that look
+// like templates with the variables they use, and the ignore patterns of the
+// config, with empty hooks. Create honors it once edited. It returns the path
+// of the file.
+func (c *Client) Init(ctx context.Context, dir string, opts InitOptions) (string, error) {
+	name := StashFileYAML
+	switch opts.Format {
+	case "", "yaml":
+	case "json":
+		name = StashFileJSON
+	default:
+		return "", fail("init", "", ErrStashFileFormat)
+	}
+	for _, v := range []string{StashFileYAML, StashFileJSON} {
+		fp := filepath.Join(dir, v)
+		if _, err := os.Stat(fp); err == nil {
+			if !opts.Force {
+				return "", fail("init", "", ErrStashFileExists)
+			}
+			if err := os.Remove(fp); err != nil {
+				return "", fail("init", "", err)
+			}
+		}
+	}
+	sf, err := generateStashFile(dir, c.config.Ignore)
+	if err != nil {
+		return "", fail("init", "", err)
+	}
+	if err := writeStashFile(dir, name, sf); err != nil {
+		return "", fail("init", "", err)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// CaptureOptions holds the settings for capturing files back into a stash.
+type CaptureOptions struct {
+	// Paths are glob patterns of the files to capture
+	Paths []string
+	// Templatize replaces the values of the data recorded in the lock file
+	// with the template actions that print them
+	Templatize bool
+	// Version names the new version, by default the next number
+	Version string
+}
+
+// Capture writes files of dir, expanded from a stash, back into the stash as
+// a new version. Without a name, the stash in the lock file of dir is used;
+// stashes of read-only homes and of remotes can not be captured into.
+func (c *Client) Capture(ctx context.Context, stashName, dir string, opts CaptureOptions) ([]FileChange, error) {
+	if stashName == "" {
+		if l, err := readLockFile(dir); err == nil && (l.Remote != "" || l.Home != "" && l.Home != LocalHome) {
+			return nil, fail("capture", stashName, ErrReadOnlyHome)
+		}
+	}
+	store, name, err := c.openWritable(ctx, stashName)
+	if err != nil {
+		return nil, fail("capture", stashName, err)
+	}
+	changes, err := captureFiles(name, store, dir, captureOptions{
+		paths:      opts.Paths,
+		templatize: opts.Templatize,
+		version:    opts.Version,
+	})
+	if err != nil {
+		return nil, fail("capture", stashName, err)
+	}
+	if name == "" {
+		l, _ := readLockFile(dir)
+		name = l.Stash
+	}
+	return changes, fail("capture", stashName, c.save(ctx, "capture "+name, name))
+}
+
+// Diff compares a stash, as it would be expanded with the data, only and
+// exclude options, to dir.
+func (c *Client) Diff(ctx context.Context, stashName, dir string, opts ExpandOptions) ([]FileDiff, error) {
+	if _, err := c.open(ctx); err != nil {
+		return nil, fail("diff", stashName, err)
+	}
+	h, name, err := c.resolve(stashName)
+	if err != nil {
+		return nil, fail("diff", stashName, err)
+	}
+	o, err := c.expandOptions(opts)
+	if err != nil {
+		return nil, fail("diff", stashName, err)
+	}
+	diffs, err := diffStash(name, c.storeOf(h), dir, o)
+	return diffs, fail("diff", stashName, err)
+}
+
+// UpgradeOptions holds the optional settings for upgrading a directory.
+type UpgradeOptions struct {
+	// Version to upgrade to, the latest one by default
+	Version string
+	// Data is merged over the data recorded in the lock file
+	Data map[string]string
+}
+
+// Upgrade brings the changes of a newer version of the stash recorded in the
+// lock file of dir into dir. Conflicting changes are marked in the files. A
+// stash expanded from a remote is fetched from it again.
+func (c *Client) Upgrade(ctx context.Context, dir string, opts UpgradeOptions) ([]FileChange, error) {
+	store, err := c.open(ctx)
+	if err != nil {
+		return nil, fail("upgrade", "", err)
+	}
+	if l, err := readLockFile(dir); err == nil && l.Remote != "" {
+		// the stash of the remote it was expanded from, not a local one of
+		// the same name
+		if store, err = c.fetch(ctx, l.Remote, l.Stash, opts.Version); err != nil {
+			return nil, fail("upgrade", "", err)
+		}
+	} else if err == nil {
+		ref := l.Stash
+		if l.Home != "" {
+			// the stash of the lock file, not one of the same name earlier in
+			// the search path
+			ref = l.Home + ":" + l.Stash
+		}
+		h, _, err := c.resolve(ref)
+		if err != nil {
+			return nil, fail("upgrade", "", err)
+		}
+		store = c.storeOf(h)
+	}
+	changes, err := upgradeDir(store, dir, upgradeOptions{version: opts.Version, data: opts.Data})
+	return changes, fail("upgrade", "", err)
+}
+
+// Status lists the files of dir modified since it was expanded with a lock
+// file.
+func (c *Client) Status(ctx context.Context, dir string) ([]FileChange, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fail("status", "", err)
+	}
+	changes, err := lockStatus(dir)
+	return changes, fail("status", "", err)
+}
+
+// Rename renames a stash.
+func (c *Client) Rename(ctx context.Context, oldName, newName string) error {
+	store, name, err := c.openWritable(ctx, oldName)
+	if err != nil {
+		return fail("rename", oldName, err)
+	}
+	newName, err = writable(newName)
+	if err != nil {
+		return fail("rename", oldName, err)
+	}
+	if err := renameStash(name, newName, store); err != nil {
+		return fail("rename", oldName, err)
+	}
+	return fail("rename", oldName, c.save(ctx, "rename "+name+" to "+newName, newName))
+}
+
+// Copy copies a stash, with its versions, under a new name. The stash may be
+// in any home, the copy goes to the writable one.
+func (c *Client) Copy(ctx context.Context, srcName, dstName string) error {
+	store, name, err := c.openWritable(ctx, dstName)
+	if err != nil {
+		return fail("copy", srcName, err)
+	}
+	h, src, err := c.resolve(srcName)
+	if err != nil {
+		return fail("copy", srcName, err)
+	}
+	if h.Name == LocalHome {
+		err = copyStash(src, name, store)
+	} else {
+		err = copyAcross(c.storeOf(h), src, store, name, h.Path)
+	}
+	if err != nil {
+		return fail("copy", srcName, err)
+	}
+	return fail("copy", srcName, c.save(ctx, "copy "+srcName+" to "+name, name))
+}
+
+// Delete deletes a stash.
+func (c *Client) Delete(ctx context.Context, stashName string) error {
+	store, name, err := c.openWritable(ctx, stashName)
+	if err != nil {
+		return fail("delete", stashName, err)
+	}
+	if err := deleteStash(name, store); err != nil {
+		return fail("delete", stashName, err)
+	}
+	return fail("delete", stashName, c.save(ctx, "delete "+name))
+}
+
+// Export writes the stashes, or all of them when names is empty, with their
+// versions into an archive of the format, FormatTarGz or FormatZip.
+func (c *Client) Export(ctx context.Context, names []string, w io.Writer, format string) error {
+	store, err := c.open(ctx)
+	if err != nil {
+		return fail("export", "", err)
+	}
+	return fail("export", "", exportStashes(names, store, w, format))
+}
+
+// ImportOptions holds the settings for importing stashes.
+type ImportOptions struct {
+	// Name is the name of the imported stash, by default its name in the
+	// archive or the base name of the directory
+	Name string
+	// OnConflict is one of the Conflict policies, by default the one of the
+	// config or ConflictFail
+	OnConflict string
+	// Ref is a git ref to import, which makes the source a git repository
+	Ref string
+	// Subdir is a directory inside the git repository to import
+	Subdir string
+}
+
+// Import imports stashes from an archive made by Export, a directory or a
+// ref of a git repository, and returns their names.
+func (c *Client) Import(ctx context.Context, src string, opts ImportOptions) ([]string, error) {
+	store, err := c.open(ctx)
+	if err != nil {
+		return nil, fail("import", "", err)
+	}
+	if opts.OnConflict == "" {
+		opts.OnConflict = c.config.OnConflict
+	}
+	names, err := importStashes(ctx, src, store, importOptions{
+		name:       opts.Name,
+		onConflict: opts.OnConflict,
+		ref:        opts.Ref,
+		subdir:     opts.Subdir,
+	})
+	if len(names) > 0 {
+		if err := c.save(ctx, "import "+src, names...); err != nil {
+			return names, fail("import", "", err)
+		}
+	}
+	return names, fail("import", "", err)
+}
+
+// Handler returns the HTTP API sharing the stashes, for clients sending the
+// token as Authorization: Bearer <token>.
+func (c *Client) Handler(token string) http.Handler {
+	return newServer(c.store, token)
+}
+
+// Remotes returns the remotes added to fstash home, followed by the ones of
+// the config with other names.
+func (c *Client) Remotes(ctx context.Context) ([]Remote, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fail("remote list", "", err)
+	}
+	remotes, err := c.remotes()
+	return remotes, fail("remote list", "", err)
+}
+
+func (c *Client) remotes() ([]Remote, error) {
+	remotes, err := readRemotes(c.home)
+	if err != nil {
+		return nil, err
+	}
+	added := make(map[string]bool)
+	for _, r := range remotes {
+		added[r.Name] = true
+	}
+	for _, r := range c.config.Remotes {
+		if !added[r.Name] {
+			remotes = append(remotes, r)
+		}
+	}
+	return remotes, nil
+}
+
+func (c *Client) findRemote(name string) (*Remote, error) {
+	remotes, err := c.remotes()
+	if err != nil {
+		return nil, err
+	}
+	for i := range remotes {
+		if remotes[i].Name == name {
+			return &remotes[i], nil
+		}
+	}
+	return nil, ErrRemoteNotExist
+}
+
+// AddRemote adds a stash server, as served by Handler, to push to and pull
+// from.
+func (c *Client) AddRemote(ctx context.Context, name, url, token string) error {
+	if err := ctx.Err(); err != nil {
+		return fail("remote add", "", err)
+	}
+	return fail("remote add", "", addRemote(c.home, name, url, token))
+}
+
+// RemoveRemote removes a remote.
+func (c *Client) RemoveRemote(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return fail("remote remove", "", err)
+	}
+	return fail("remote remove", "", removeRemote(c.home, name))
+}
+
+// Push sends a stash, with its versions, to a remote and returns the
+// manifest of the stash there.
+func (c *Client) Push(ctx context.Context, stashName, remoteName string) (*Manifest, error) {
+	store, name, err := c.openWritable(ctx, stashName)
+	if err != nil {
+		return nil, fail("push", stashName, err)
+	}
+	r, err := c.findRemote(remoteName)
+	if err != nil {
+		return nil, fail("push", stashName, err)
+	}
+	m, err := pushStash(ctx, name, store, r)
+	if err != nil {
+		return nil, fail("push", stashName, err)
+	}
+	// a stash without versions gets its first one when pushed
+	return m, fail("push", stashName, c.save(ctx, "push "+name, name))
+}
+
+// Pull fetches a stash, with its versions, from a remote given as
+// remote/name, or remote/name@version to make that version current.
+func (c *Client) Pull(ctx context.Context, ref string) error {
+	remoteName, name, version, ok := parseRemoteRef(ref)
+	if !ok {
+		return fail("pull", ref, ErrInvalidRemoteRef)
+	}
+	store, err := c.open(ctx)
+	if err != nil {
+		return fail("pull", ref, err)
+	}
+	r, err := c.findRemote(remoteName)
+	if err != nil {
+		return fail("pull", ref, err)
+	}
+	if err := pullStash(ctx, name, version, store, r); err != nil {
+		return fail("pull", ref, err)
+	}
+	return fail("pull", ref, c.save(ctx, "pull "+ref, name))
+}
+
+// Migrate copies all stashes of the client, with their versions, into
+// another store and returns the number of files copied. Nothing is deleted
+// from the store, and files it already has are overwritten. A store that can
+// batch changes, like bolt, gets all of them at once.
+func (c *Client) Migrate(ctx context.Context, to Store) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fail("migrate", "", err)
+	}
+	n, err := copyStore(to, c.store)
+	return n, fail("migrate", "", err)
+}
+
+// MigrateFrom copies all stashes of another store, with their versions, into
+// the store of the client and returns the number of files copied. Like
+// Migrate, nothing is deleted and files the client already has are
+// overwritten.
+func (c *Client) MigrateFrom(ctx context.Context, from Store) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fail("migrate", "", err)
+	}
+	n, err := copyStore(c.store, from)
+	if err != nil {
+		return n, fail("migrate", "", err)
+	}
+	return n, fail("migrate", "", c.save(ctx, "migrate from a store"))
+}
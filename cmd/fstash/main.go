@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/workshop-depot/fstash"
+
+	"github.com/alecthomas/kingpin"
+)
+
+func main() {
+	command := kingpin.Parse()
+	ctx := context.Background()
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	homes, err := searchPath(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var project string
+	if !*noProject {
+		project = fstash.FindProjectHome(_wd, _appHome)
+	}
+	store, err := fstash.OpenStore(*storeSpec, _appHome)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if c, ok := store.(io.Closer); ok {
+		defer c.Close()
+	}
+	client, err := fstash.New(_appHome,
+		fstash.WithStore(store),
+		fstash.WithConfig(cfg),
+		fstash.WithSearchPath(homes...),
+		fstash.WithProjectHome(project),
+		fstash.WithHookConfirm(confirmHooks))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	switch command {
+	case "create":
+		opts := fstash.CreateOptions{
+			Templates:  *createTemplates,
+			PreExpand:  *createPreExpand,
+			PostExpand: *createPostExpand,
+			Version:    *createVersion,
+			Meta: fstash.Meta{
+				Description: *createDescription,
+				Tags:        *createTags,
+				Author:      *createAuthor,
+				Homepage:    *createHomepage,
+			},
+		}
+		if err := client.Create(ctx, *createStashName, *createStashContent, opts); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "expand":
+		if *expandDstDir == "." {
+			*expandDstDir = _wd
+		}
+		templatesData, err := fstash.LoadData(os.Environ(), *expandDataFiles, *expandData)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts := fstash.ExpandOptions{
+			Data:    templatesData,
+			Files:   *expandFiles,
+			Only:    *expandOnly,
+			Exclude: *expandExclude,
+			Lock:    *expandLock,
+			Secrets: *expandSecrets,
+			NoHooks: *expandNoHooks,
+		}
+		switch {
+		case *expandGit != "":
+			err = client.ExpandGit(ctx, *expandGit, *expandRef, *expandSubdir, *expandDstDir, opts)
+		case *expandStashName == "":
+			fmt.Println("either a stash name or --git is needed")
+			return
+		default:
+			err = client.Expand(ctx, *expandStashName, *expandDstDir, opts)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "update":
+		changes, err := client.Update(ctx, *updateStashName, *updateVersion)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(changes) == 0 {
+			fmt.Println("stash is up to date")
+		}
+		printChanges(changes)
+	case "init":
+		if *initDirectory == "." {
+			*initDirectory = _wd
+		}
+		opts := fstash.InitOptions{Format: *initFormat, Force: *initForce}
+		fp, err := client.Init(ctx, *initDirectory, opts)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(fp)
+	case "capture":
+		if *captureDirectory == "." {
+			*captureDirectory = _wd
+		}
+		opts := fstash.CaptureOptions{
+			Paths:      *capturePaths,
+			Templatize: *captureTemplatize,
+			Version:    *captureVersion,
+		}
+		changes, err := client.Capture(ctx, *captureStashName, *captureDirectory, opts)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(changes) == 0 {
+			fmt.Println("nothing to capture")
+		}
+		printChanges(changes)
+	case "diff":
+		if *diffDir == "." {
+			*diffDir = _wd
+		}
+		templatesData, err := fstash.LoadData(os.Environ(), *diffDataFiles, *diffData)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		opts := fstash.ExpandOptions{
+			Data:    templatesData,
+			Only:    *diffOnly,
+			Exclude: *diffExclude,
+		}
+		diffs, err := client.Diff(ctx, *diffStashName, *diffDir, opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		if err := fstash.PrintDiff(os.Stdout, diffs, *diffStat); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+	case "upgrade":
+		if *upgradeDirectory == "." {
+			*upgradeDirectory = _wd
+		}
+		templatesData, err := fstash.LoadData(os.Environ(), *upgradeDataFiles, *upgradeData)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		opts := fstash.UpgradeOptions{
+			Version: *upgradeVersion,
+			Data:    templatesData,
+		}
+		changes, err := client.Upgrade(ctx, *upgradeDirectory, opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		printChanges(changes)
+		for _, v := range changes {
+			if v.Action == "conflict" {
+				os.Exit(1)
+			}
+		}
+	case "status":
+		if *statusDirectory == "." {
+			*statusDirectory = _wd
+		}
+		changes, err := client.Status(ctx, *statusDirectory)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		printChanges(changes)
+	case "list":
+		l, err := client.ListAll(ctx)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		var items []interface{}
+		for _, v := range l {
+			items = append(items, v.Ref())
+		}
+		fmt.Println(items...)
+	case "meta":
+		m, err := client.Manifest(ctx, *metaStashName)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		meta, changed := editMeta(m.Meta)
+		if !changed {
+			printMeta(m.Meta)
+			return
+		}
+		if err := client.SetMeta(ctx, *metaStashName, meta); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "search":
+		results, err := client.Search(ctx, *searchText)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, r := range results {
+			fmt.Printf("%s\t%s\n", r.Ref(), r.Description)
+			for _, f := range r.Files {
+				fmt.Printf("  %s\n", f)
+			}
+		}
+	case "rename":
+		if err := client.Rename(ctx, *renameOldName, *renameNewName); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "copy":
+		if err := client.Copy(ctx, *copySrcName, *copyDstName); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "export":
+		if len(*exportStashNames) == 0 && !*exportAll {
+			fmt.Println("either stash names or --all is needed")
+			return
+		}
+		format := *exportFormat
+		if format == "" {
+			format = fstash.ArchiveFormat(*exportOutput)
+		}
+		var w io.WriteCloser = os.Stdout
+		if *exportOutput != "-" {
+			f, err := os.Create(*exportOutput)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			w = f
+		}
+		if err := client.Export(ctx, *exportStashNames, w, format); err != nil {
+			w.Close()
+			fmt.Println(err)
+			return
+		}
+		if err := w.Close(); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "import":
+		opts := fstash.ImportOptions{
+			Name:       *importStashName,
+			OnConflict: *importOnConflict,
+			Ref:        *importRef,
+			Subdir:     *importSubdir,
+		}
+		names, err := client.Import(ctx, *importSource, opts)
+		for _, v := range names {
+			fmt.Println(v)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "serve":
+		handler := client.Handler(*serveToken)
+		fmt.Println("serving stashes on", *serveAddr)
+		if err := http.ListenAndServe(*serveAddr, handler); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "remote add":
+		if err := client.AddRemote(ctx, *remoteAddName, *remoteAddURL, *remoteAddToken); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "remote remove":
+		if err := client.RemoveRemote(ctx, *remoteRemoveName); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "remote list":
+		remotes, err := client.Remotes(ctx)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, r := range remotes {
+			fmt.Printf("%s\t%s\n", r.Name, r.URL)
+		}
+	case "push":
+		m, err := client.Push(ctx, *pushStashName, *pushRemote)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("pushed %s version %s to %s\n", m.Name, m.Version, *pushRemote)
+	case "pull":
+		if err := client.Pull(ctx, *pullRef); err != nil {
+			fmt.Println(err)
+			return
+		}
+	case "migrate":
+		spec := *migrateTo
+		if (spec == "") == (*migrateFrom == "") {
+			fmt.Println("give either --to or --from")
+			return
+		}
+		if spec == "" {
+			spec = *migrateFrom
+		}
+		if spec == *storeSpec {
+			fmt.Println("the stashes are kept there already")
+			return
+		}
+		other, err := fstash.OpenStore(spec, _appHome)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if c, ok := other.(io.Closer); ok {
+			defer c.Close()
+		}
+		var n int
+		if *migrateTo != "" {
+			n, err = client.Migrate(ctx, other)
+		} else {
+			n, err = client.MigrateFrom(ctx, other)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("copied %d files\n", n)
+	case "delete":
+		if err := client.Delete(ctx, *deleteStashName); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
+
+// loadConfig reads the config file and sets fstash home from --home, or the
+// environment and the config.
+func loadConfig() (*fstash.Config, error) {
+	fp := *configFile
+	if fp == "" {
+		var err error
+		if fp, err = fstash.DefaultConfigPath(os.Getenv); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := fstash.LoadConfig(fp)
+	if err != nil {
+		return nil, err
+	}
+	_appHome = *homeDir
+	if _appHome == "" {
+		if _appHome, err = fstash.DefaultHome(cfg, os.Getenv); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// searchPath returns the homes of --search-path, or else of FSTASH_PATH or the config.
+func searchPath(cfg *fstash.Config) ([]fstash.SearchHome, error) {
+	entries := *searchHomes
+	if len(entries) == 0 {
+		if v := os.Getenv("FSTASH_PATH"); v != "" {
+			entries = filepath.SplitList(v)
+		} else {
+			entries = cfg.Path
+		}
+	}
+	return fstash.ParseSearchPath(entries)
+}
+
+// editMeta applies the flags of meta, telling whether there was any.
+func editMeta(meta fstash.Meta) (fstash.Meta, bool) {
+	changed := false
+	for _, v := range *metaClear {
+		switch v {
+		case "description":
+			meta.Description = ""
+		case "tags":
+			meta.Tags = nil
+		case "author":
+			meta.Author = ""
+		case "homepage":
+			meta.Homepage = ""
+		}
+		changed = true
+	}
+	if *metaDescription != "" {
+		meta.Description, changed = *metaDescription, true
+	}
+	if *metaAuthor != "" {
+		meta.Author, changed = *metaAuthor, true
+	}
+	if *metaHomepage != "" {
+		meta.Homepage, changed = *metaHomepage, true
+	}
+	if len(*metaTags) > 0 {
+		meta.Tags, changed = append(meta.Tags, *metaTags...), true
+	}
+	if len(*metaUntags) > 0 {
+		var tags []string
+		for _, t := range meta.Tags {
+			keep := true
+			for _, v := range *metaUntags {
+				if strings.EqualFold(t, v) {
+					keep = false
+				}
+			}
+			if keep {
+				tags = append(tags, t)
+			}
+		}
+		meta.Tags, changed = tags, true
+	}
+	return meta, changed
+}
+
+func printMeta(meta fstash.Meta) {
+	fmt.Printf("description: %s\n", meta.Description)
+	fmt.Printf("tags:        %s\n", strings.Join(meta.Tags, ", "))
+	fmt.Printf("author:      %s\n", meta.Author)
+	fmt.Printf("homepage:    %s\n", meta.Homepage)
+}
+
+func printChanges(changes []fstash.FileChange) {
+	for _, v := range changes {
+		fmt.Printf("%-8s %s\n", v.Action, v.Path)
+	}
+}
+
+var (
+	homeDir     = kingpin.Flag("home", "fstash home, where the stashes are kept; by default FSTASH_HOME, the home of the config file or ~/.fstash").String()
+	searchHomes = kingpin.Flag("search-path", "a read-only fstash home, as name=path or path, searched after fstash home; can be repeated, by default FSTASH_PATH or the path of the config file").Strings()
+	storeSpec   = kingpin.Flag("store", "where the stashes of fstash home are kept: dir, its directory layout, bolt, a single database file in it, bolt:<path> or s3://bucket/prefix").Envar("FSTASH_STORE").Default("dir").String()
+	noProject   = kingpin.Flag("no-project", "do not look up the stashes of the .fstash directory of the project").Bool()
+	configFile  = kingpin.Flag("config", "the config file, by default ~/.config/fstash/config.yaml").Envar("FSTASH_CONFIG").String()
+
+	createCommand      = kingpin.Command("create", "creating stash based on the content of a directory")
+	createStashName    = createCommand.Flag("stash-name", "name of this stash, lower case, only numbers, alphabet and - and _").Short('n').Required().String()
+	createStashContent = createCommand.Flag("stash-content", "file or directory to stash, as src or src:dst where dst is its path inside the stash; can be repeated").Short('c').Default(".").Strings()
+	createVersion      = createCommand.Flag("version", "name of this version of the stash, by default the next number").String()
+	createTemplates    = createCommand.Flag("template", "glob pattern of template files, can be repeated; files ending with .tmpl are always templates").Short('t').Strings()
+	createPreExpand    = createCommand.Flag("pre-expand", "command to run in the destination directory before expanding, can be repeated").Strings()
+	createPostExpand   = createCommand.Flag("post-expand", "command to run in the destination directory after expanding, can be repeated").Strings()
+	createDescription  = createCommand.Flag("description", "what the stash is for").String()
+	createTags         = createCommand.Flag("tag", "tag of the stash, lower case, only numbers, alphabet and - and _; can be repeated").Strings()
+	createAuthor       = createCommand.Flag("author", "author of the stash").String()
+	createHomepage     = createCommand.Flag("homepage", "http or https URL about the stash").String()
+
+	expandCommand   = kingpin.Command("expand", "expand stash and expand it into a directory")
+	expandStashName = expandCommand.Flag("stash-name", "name of this stash, lower case, only numbers, alphabet and - and _; home:name picks it from a home of the search path and remote/name[@version] fetches it from a remote").Short('n').String()
+	expandGit       = expandCommand.Flag("git", "expand a git repository, a path or a URL, instead of a stash").String()
+	expandRef       = expandCommand.Flag("ref", "git ref to expand with --git").Default("HEAD").String()
+	expandSubdir    = expandCommand.Flag("subdir", "directory inside the git repository to expand with --git").String()
+	expandDstDir    = expandCommand.Flag("destination", "the directory that its content will be expanded to").Short('d').Default(".").String()
+	expandFiles     = expandCommand.Flag("file", "path of a file inside the stash to expand, instead of the whole stash; can be repeated").Short('f').Strings()
+	expandOnly      = expandCommand.Flag("only", "glob pattern of the files to expand, like 'ci/**'; can be repeated").Strings()
+	expandExclude   = expandCommand.Flag("exclude", "glob pattern of the files not to expand; can be repeated").Strings()
+	expandLock      = expandCommand.Flag("lock", "write a "+fstash.LockFileName+" file recording the stash, its version and the data, used by upgrade").Bool()
+	expandSecrets   = expandCommand.Flag("secret", "name of a data value not to record in the lock file, on top of names like password or token; can be repeated").Strings()
+	expandNoHooks   = expandCommand.Flag("no-hooks", "do not run the pre-expand and post-expand hooks of the stash").Bool()
+	expandYes       = expandCommand.Flag("yes", "run the hooks of an imported stash without asking").Short('y').Bool()
+	expandDataFiles = expandCommand.Flag("data-file", "json, yaml, toml or .env file of data for template files, by file name; can be repeated").Strings()
+	expandData      = expandCommand.Arg("data", "json data for template files, multiple ones with format filename1=JSON filename2=@file").StringMap()
+
+	updateCommand   = kingpin.Command("update", "sync a stash with the files and directories it was created from, as a new version")
+	updateStashName = updateCommand.Flag("stash-name", "name of the stash to update").Short('n').Required().String()
+	updateVersion   = updateCommand.Flag("version", "name of the new version of the stash, by default the next number").String()
+
+	initCommand   = kingpin.Command("init", "describe the files of a directory, and the ones that look like templates, in a "+fstash.StashFileYAML+" file that create honors")
+	initDirectory = initCommand.Flag("destination", "the directory to describe").Short('d').Default(".").String()
+	initFormat    = initCommand.Flag("format", "yaml or json").Default("yaml").Enum("yaml", "json")
+	initForce     = initCommand.Flag("force", "replace the stash file of the directory").Bool()
+
+	captureCommand    = kingpin.Command("capture", "write files of a directory, expanded from a stash, back into the stash as a new version")
+	captureStashName  = captureCommand.Flag("stash-name", "name of the stash, by default the one in the lock file of the directory").Short('n').String()
+	captureDirectory  = captureCommand.Flag("destination", "the directory to capture files from").Short('d').Default(".").String()
+	capturePaths      = captureCommand.Flag("path", "glob pattern of the files to capture, like ci/; can be repeated").Short('p').Required().Strings()
+	captureTemplatize = captureCommand.Flag("templatize", "replace the values of the data recorded in the lock file with their template variables").Bool()
+	captureVersion    = captureCommand.Flag("version", "name of the new version of the stash, by default the next number").String()
+
+	diffCommand   = kingpin.Command("diff", "compare a stash to a directory; exits with 1 if they differ and 2 on errors")
+	diffStashName = diffCommand.Flag("stash-name", "name of the stash to compare").Short('n').Required().String()
+	diffDir       = diffCommand.Flag("destination", "the directory to compare the stash to").Short('d').Default(".").String()
+	diffStat      = diffCommand.Flag("stat", "only list the differing files and a summary").Bool()
+	diffOnly      = diffCommand.Flag("only", "glob pattern of the files to compare; can be repeated").Strings()
+	diffExclude   = diffCommand.Flag("exclude", "glob pattern of the files not to compare; can be repeated").Strings()
+	diffDataFiles = diffCommand.Flag("data-file", "json, yaml, toml or .env file of data for template files, by file name; can be repeated").Strings()
+	diffData      = diffCommand.Arg("data", "json data for template files, multiple ones with format filename1=JSON filename2=@file").StringMap()
+
+	upgradeCommand   = kingpin.Command("upgrade", "bring changes from a newer version of a stash into a directory expanded with --lock; exits with 1 on conflicts")
+	upgradeDirectory = upgradeCommand.Flag("destination", "the directory to upgrade").Short('d').Default(".").String()
+	upgradeVersion   = upgradeCommand.Flag("to", "the version to upgrade to, the latest one by default").String()
+	upgradeDataFiles = upgradeCommand.Flag("data-file", "json, yaml, toml or .env file of data for template files, by file name, over the data used on expand; can be repeated").Strings()
+	upgradeData      = upgradeCommand.Arg("data", "json data for template files, over the data used on expand, multiple ones with format filename1=JSON filename2=@file").StringMap()
+
+	statusCommand   = kingpin.Command("status", "list the files modified since the directory was expanded with --lock")
+	statusDirectory = statusCommand.Flag("destination", "the directory expanded with --lock").Short('d').Default(".").String()
+
+	listCommand = kingpin.Command("list", "lists existing file stashes")
+
+	metaCommand     = kingpin.Command("meta", "show or change the description, tags, author and homepage of a stash")
+	metaStashName   = metaCommand.Flag("stash-name", "name of the stash").Short('n').Required().String()
+	metaDescription = metaCommand.Flag("description", "what the stash is for").String()
+	metaTags        = metaCommand.Flag("tag", "tag to add, can be repeated").Strings()
+	metaUntags      = metaCommand.Flag("untag", "tag to remove, can be repeated").Strings()
+	metaAuthor      = metaCommand.Flag("author", "author of the stash").String()
+	metaHomepage    = metaCommand.Flag("homepage", "http or https URL about the stash").String()
+	metaClear       = metaCommand.Flag("clear", "field to clear: description, tags, author or homepage; can be repeated").Enums("description", "tags", "author", "homepage")
+
+	searchCommand = kingpin.Command("search", "find stashes by name, description, tags or file paths, of all homes")
+	searchText    = searchCommand.Arg("text", "text to look for, ignoring case").Required().String()
+
+	renameCommand = kingpin.Command("rename", "rename a stash")
+	renameOldName = renameCommand.Arg("old", "current name of the stash").Required().String()
+	renameNewName = renameCommand.Arg("new", "new name of the stash, lower case, only numbers, alphabet and - and _").Required().String()
+
+	copyCommand = kingpin.Command("copy", "copy a stash, with its versions, under a new name")
+	copySrcName = copyCommand.Arg("src", "name of the stash to copy").Required().String()
+	copyDstName = copyCommand.Arg("dst", "name of the copy, lower case, only numbers, alphabet and - and _").Required().String()
+
+	exportCommand    = kingpin.Command("export", "export stashes, with their versions, into a tar.gz or zip archive")
+	exportStashNames = exportCommand.Flag("stash-name", "name of a stash to export; can be repeated").Short('n').Strings()
+	exportAll        = exportCommand.Flag("all", "export all stashes, for backup").Bool()
+	exportOutput     = exportCommand.Flag("output", "the archive file, - for stdout").Short('o').Required().String()
+	exportFormat     = exportCommand.Flag("format", "tar.gz or zip, by default guessed from the output file name").Enum(fstash.FormatTarGz, fstash.FormatZip)
+
+	importCommand    = kingpin.Command("import", "import stashes from an archive made by export, a directory or a git repository")
+	importSource     = importCommand.Arg("source", "the archive, directory or git repository to import").Required().String()
+	importStashName  = importCommand.Flag("stash-name", "name of the imported stash, by default its name in the archive or the base name of the directory").Short('n').String()
+	importOnConflict = importCommand.Flag("on-conflict", "when the name is taken: fail, rename to name-2, name-3, ..., add a new version of the existing stash or merge the versions of both; by default the on_conflict of the config, or fail").Enum(fstash.ConflictFail, fstash.ConflictRename, fstash.ConflictVersion, fstash.ConflictMerge)
+	importRef        = importCommand.Flag("ref", "git ref to import, the source is then a git repository").String()
+	importSubdir     = importCommand.Flag("subdir", "directory inside the git repository to import").String()
+
+	serveCommand = kingpin.Command("serve", "share the stashes over HTTP")
+	serveAddr    = serveCommand.Flag("addr", "address to listen on").Default("localhost:8080").String()
+	serveToken   = serveCommand.Flag("token", "token the clients must send as Authorization: Bearer <token>").Envar("FSTASH_TOKEN").Required().String()
+
+	remoteCommand       = kingpin.Command("remote", "manage the stash servers to push to and pull from")
+	remoteAddCommand    = remoteCommand.Command("add", "add a remote")
+	remoteAddName       = remoteAddCommand.Arg("name", "name of the remote, only numbers, alphabet and - and _").Required().String()
+	remoteAddURL        = remoteAddCommand.Arg("url", "URL of the server, as served by fstash serve").Required().String()
+	remoteAddToken      = remoteAddCommand.Flag("token", "token of the server").Envar("FSTASH_TOKEN").String()
+	remoteRemoveCommand = remoteCommand.Command("remove", "remove a remote")
+	remoteRemoveName    = remoteRemoveCommand.Arg("name", "name of the remote").Required().String()
+	remoteListCommand   = remoteCommand.Command("list", "list the remotes")
+
+	pushCommand   = kingpin.Command("push", "send a stash, with its versions, to a remote")
+	pushStashName = pushCommand.Flag("stash-name", "name of the stash to push").Short('n').Required().String()
+	pushRemote    = pushCommand.Arg("remote", "name of the remote").Required().String()
+
+	pullCommand = kingpin.Command("pull", "fetch a stash, with its versions, from a remote")
+	pullRef     = pullCommand.Arg("stash", "remote/name, or remote/name@version to make that version current").Required().String()
+
+	migrateCommand = kingpin.Command("migrate", "copy all stashes of the store into another one, or back from it")
+	migrateTo      = migrateCommand.Flag("to", "the store to copy to: dir, bolt, bolt:<path> or s3://bucket/prefix").String()
+	migrateFrom    = migrateCommand.Flag("from", "the store to copy from: dir, bolt, bolt:<path> or s3://bucket/prefix").String()
+
+	deleteCommand   = kingpin.Command("delete", "delete existing file stashe")
+	deleteStashName = deleteCommand.Flag("stash-name", "name of the file stash to delete, lower case, only numbers, alphabet and - and _").Short('n').Required().String()
+)
+
+// confirmHooks asks the user before running the hooks of a stash that was
+// not created on this machine, or that has hooks from stash files.
+func confirmHooks(m *fstash.Manifest, hooks *fstash.Hooks) bool {
+	if *expandYes {
+		return true
+	}
+	if m.Origin != "" {
+		fmt.Printf("stash %s comes from %s and wants to run:\n", m.Name, m.Origin)
+	} else {
+		fmt.Printf("stash %s has hooks from its stash files and wants to run:\n", m.Name)
+	}
+	for _, v := range hooks.PreExpand {
+		fmt.Println("  (pre-expand) ", v)
+	}
+	for _, v := range hooks.PostExpand {
+		fmt.Println("  (post-expand)", v)
+	}
+	fmt.Print("run these hooks? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	var err error
+	_wd, err = os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	kingpin.CommandLine.HelpFlag.Short('h')
+}
+
+var (
+	_appHome string
+	_wd      string
+)
@@ -0,0 +1,158 @@
+package fstash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config holds the defaults of fstash, kept in config.yaml:
+//
+//	home: ~/stashes
+//	path: [team=/mnt/share/stashes, ~/repos/skeletons]
+//	ignore: [node_modules/, "*.log"]
+//	on_conflict: rename
+//	data:
+//	  variables:
+//	    Author: Kaveh
+//	remotes:
+//	  - name: team
+//	    url: https://stashes.example.com
+//	    token: secret
+type Config struct {
+	// Home is fstash home, when neither --home nor FSTASH_HOME is set
+	Home string `yaml:"home"`
+	// Path are read-only fstash homes searched after fstash home, as name=path
+	// or path, when FSTASH_PATH is not set
+	Path []string `yaml:"path"`
+	// Ignore are glob patterns of files never stashed, on top of .git
+	Ignore []string `yaml:"ignore"`
+	// OnConflict is the conflict policy of import
+	OnConflict string `yaml:"on_conflict"`
+	// Data holds default data for templates, by template key; data given on
+	// expand replaces it field by field
+	Data map[string]interface{} `yaml:"data"`
+	// Remotes are used along the ones added with fstash remote add
+	Remotes []Remote `yaml:"remotes"`
+
+	// data is Data as json
+	data map[string]string
+}
+
+// DefaultConfigPath returns config.yaml inside the fstash directory of
+// XDG_CONFIG_HOME, ~/.config by default.
+func DefaultConfigPath(getenv func(string) string) (string, error) {
+	dir := getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := userHomeDir(getenv)
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "fstash", "config.yaml"), nil
+}
+
+// LoadConfig reads a config file. A missing file is an empty config.
+func LoadConfig(fp string) (*Config, error) {
+	cfg := &Config{}
+	content, err := ioutil.ReadFile(fp)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fp, err)
+	}
+	switch cfg.OnConflict {
+	case "", ConflictFail, ConflictRename, ConflictVersion, ConflictMerge:
+	default:
+		return nil, fmt.Errorf("%s: %w", fp, ErrUnknownConflict)
+	}
+	cfg.data = make(map[string]string)
+	for k, v := range cfg.Data {
+		content, err := json.Marshal(jsonValue(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s: data %s: %v", fp, k, err)
+		}
+		cfg.data[k] = string(content)
+	}
+	return cfg, nil
+}
+
+// jsonValue turns the maps decoded from yaml, which have interface{} keys,
+// into maps json can encode.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// withData returns the data of the config, replaced field by field by data.
+func (cfg *Config) withData(data map[string]string) (map[string]string, error) {
+	if cfg == nil {
+		return data, nil
+	}
+	return mergeData(cfg.data, data)
+}
+
+// DefaultHome returns fstash home: FSTASH_HOME, or the home of the config,
+// or ~/.fstash. When XDG_DATA_HOME is set and there is no ~/.fstash yet, it is
+// the fstash directory inside it.
+func DefaultHome(cfg *Config, getenv func(string) string) (string, error) {
+	home := getenv("FSTASH_HOME")
+	if home == "" && cfg != nil {
+		home = cfg.Home
+	}
+	if home != "" && home != "~" && !strings.HasPrefix(home, "~/") {
+		return home, nil
+	}
+	userHome, err := userHomeDir(getenv)
+	if err != nil {
+		return "", err
+	}
+	if home != "" {
+		return filepath.Join(userHome, home[1:]), nil
+	}
+	legacy := filepath.Join(userHome, ".fstash")
+	if xdg := getenv("XDG_DATA_HOME"); xdg != "" {
+		if _, err := os.Stat(legacy); os.IsNotExist(err) {
+			return filepath.Join(xdg, "fstash"), nil
+		}
+	}
+	return legacy, nil
+}
+
+// userHomeDir returns HOME, falling back to the user database, which may
+// have no entry for the user in containers.
+func userHomeDir(getenv func(string) string) (string, error) {
+	if home := getenv("HOME"); home != "" {
+		return home, nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return home, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", ErrNoHome
+	}
+	return usr.HomeDir, nil
+}
@@ -0,0 +1,227 @@
+package fstash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// AllTemplates is the data key of the fields every template gets, under the
+// data of its own key.
+const AllTemplates = "*"
+
+// envDataPrefix starts the names of the environment variables that are data
+// for all templates, like FSTASH_VAR_Author.
+const envDataPrefix = "FSTASH_VAR_"
+
+// LoadData builds the data for templates, by template key, from the
+// FSTASH_VAR_ variables of environ, then the data files in order, then the
+// entries. Each one replaces the data before it field by field, see
+// mergeData. An entry is key=JSON, or key=@file to read the data of the key
+// from a file.
+func LoadData(environ, files []string, entries map[string]string) (map[string]string, error) {
+	var fileLayers []map[string]string
+	for _, fp := range files {
+		data, err := readDataFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		fileLayers = append(fileLayers, data)
+	}
+	// the data files are one layer, whatever their order
+	fromFiles, err := mergeLayers(fileLayers, false)
+	if err != nil {
+		return nil, err
+	}
+	given := make(map[string]string)
+	for k, v := range entries {
+		if !strings.HasPrefix(v, "@") {
+			given[k] = v
+			continue
+		}
+		fields, err := decodeDataFile(v[1:])
+		if err != nil {
+			return nil, err
+		}
+		content, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", v[1:], err)
+		}
+		given[k] = string(content)
+	}
+	return mergeData(envData(environ), fromFiles, given)
+}
+
+// envData returns the FSTASH_VAR_ variables of environ as data for all
+// templates, or nil when there are none.
+func envData(environ []string) map[string]string {
+	fields := make(map[string]interface{})
+	for _, v := range environ {
+		if !strings.HasPrefix(v, envDataPrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(v, envDataPrefix), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		fields[kv[0]] = kv[1]
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	content, _ := json.Marshal(fields)
+	return map[string]string{AllTemplates: string(content)}
+}
+
+// readDataFile reads data by template key from a file. Its values that are
+// objects are the data of their keys and the others are data for all
+// templates, which is all there is in a .env file.
+func readDataFile(fp string) (map[string]string, error) {
+	fields, err := decodeDataFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]string)
+	all := make(map[string]interface{})
+	for k, v := range fields {
+		if _, ok := v.(map[string]interface{}); !ok {
+			all[k] = v
+			continue
+		}
+		content, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", fp, k, err)
+		}
+		data[k] = string(content)
+	}
+	if len(all) > 0 {
+		if _, ok := data[AllTemplates]; ok {
+			return nil, fmt.Errorf("%s: %w", fp, ErrDataFileFormat)
+		}
+		content, err := json.Marshal(all)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fp, err)
+		}
+		data[AllTemplates] = string(content)
+	}
+	return data, nil
+}
+
+// decodeDataFile decodes a json, yaml, toml or .env file, by its extension,
+// into fields json can encode.
+func decodeDataFile(fp string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	base := filepath.Base(fp)
+	switch ext := strings.ToLower(filepath.Ext(fp)); {
+	case ext == ".json":
+		err = json.Unmarshal(content, &fields)
+	case ext == ".yaml" || ext == ".yml":
+		var v map[string]interface{}
+		if err = yaml.Unmarshal(content, &v); err == nil {
+			for k, e := range v {
+				fields[k] = jsonValue(e)
+			}
+		}
+	case ext == ".toml":
+		_, err = toml.Decode(string(content), &fields)
+	case ext == ".env" || base == ".env" || strings.HasPrefix(base, ".env."):
+		var env map[string]string
+		if env, err = godotenv.Unmarshal(string(content)); err == nil {
+			for k, v := range env {
+				fields[k] = v
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s: %w", fp, ErrDataFileFormat)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fp, err)
+	}
+	return fields, nil
+}
+
+// mergeData merges the layers of data by template key, each one replacing
+// the ones before it field by field. The data for all templates of a layer
+// goes under the data of its own keys, but over the data of the keys of the
+// layers before it.
+func mergeData(layers ...map[string]string) (map[string]string, error) {
+	return mergeLayers(layers, true)
+}
+
+// mergeLayers merges data by template key. With spread, the data for all
+// templates of each layer goes into the data of every key first.
+func mergeLayers(layers []map[string]string, spread bool) (map[string]string, error) {
+	var result map[string]string
+	for _, layer := range layers {
+		if len(layer) == 0 {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]string)
+		}
+		seen := make(map[string]bool)
+		var keys []string
+		for _, data := range []map[string]string{result, layer} {
+			for k := range data {
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			upper := layer[k]
+			if spread && k != AllTemplates {
+				var err error
+				if upper, err = mergeFields(layer[AllTemplates], upper); err != nil {
+					return nil, fmt.Errorf("data %s: %v", k, err)
+				}
+			}
+			merged, err := mergeFields(result[k], upper)
+			if err != nil {
+				return nil, fmt.Errorf("data %s: %v", k, err)
+			}
+			result[k] = merged
+		}
+	}
+	return result, nil
+}
+
+// mergeFields returns the fields of the json object lower, replaced by the
+// ones of upper.
+func mergeFields(lower, upper string) (string, error) {
+	if strings.TrimSpace(lower) == "" {
+		return upper, nil
+	}
+	if strings.TrimSpace(upper) == "" {
+		return lower, nil
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lower), &fields); err != nil {
+		return "", err
+	}
+	given := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(upper), &given); err != nil {
+		return "", err
+	}
+	for k, v := range given {
+		fields[k] = v
+	}
+	content, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,191 @@
+package fstash
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// FileDiff is the difference of one file between a stash and a directory.
+type FileDiff struct {
+	Path string
+	// Status is A for a file only in the directory, D for a file only in the
+	// stash and M for a file that differs
+	Status  byte
+	Binary  bool
+	Diff    string
+	Added   int
+	Removed int
+}
+
+// diffStash compares the stash, as it would be expanded with the options,
+// to the directory. The only and exclude options apply to both sides.
+func diffStash(stashName string, store Store, dir string, opts expandOptions) ([]FileDiff, error) {
+	m, content, err := openStash(store, stashName)
+	if err != nil {
+		return nil, err
+	}
+	if content, err = selectContent(content, opts); err != nil {
+		return nil, err
+	}
+	data, err := mergeData(m.Data, opts.data)
+	if err != nil {
+		return nil, err
+	}
+	stashFiles, err := renderContent(content, m, data)
+	if err != nil {
+		return nil, err
+	}
+
+	dirTree, err := readTree(dir, ".git")
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.only) > 0 || len(opts.exclude) > 0 {
+		dirTree = filterTree(dirTree, opts.only, opts.exclude)
+	}
+	dirFiles := make(map[string]string)
+	for d, names := range dirTree {
+		for _, f := range names {
+			rel := filepath.ToSlash(filepath.Join(d, f))
+			if rel == LockFileName {
+				continue
+			}
+			dirFiles[rel] = filepath.Join(dir, d, f)
+		}
+	}
+
+	var result []FileDiff
+	for rel, content := range stashFiles {
+		src, ok := dirFiles[rel]
+		if !ok {
+			result = append(result, diffContent(rel, 'D', content, nil))
+			continue
+		}
+		current, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(content, current) {
+			result = append(result, diffContent(rel, 'M', content, current))
+		}
+	}
+	for rel, src := range dirFiles {
+		if _, ok := stashFiles[rel]; ok {
+			continue
+		}
+		current, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, diffContent(rel, 'A', nil, current))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+// renderContent returns the content of the files of a stash, by their
+// expanded paths, without writing them anywhere. A symlink reads as the file
+// of the stash it points to, and is left out when there is none.
+func renderContent(content map[string]*archiveEntry, m *Manifest, templatesData map[string]string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for rel, entry := range content {
+		if entry.isLink() {
+			target, ok := content[path.Join(path.Dir(rel), filepath.ToSlash(entry.link))]
+			if !ok || target.isLink() {
+				continue
+			}
+			entry = target
+		}
+		rel, rendered, err := renderFile(rel, entry.content, m, templatesData)
+		if err != nil {
+			return nil, err
+		}
+		files[rel] = rendered
+	}
+	return files, nil
+}
+
+func diffContent(rel string, status byte, stashContent, dirContent []byte) FileDiff {
+	d := FileDiff{Path: rel, Status: status}
+	if isBinary(stashContent) || isBinary(dirContent) {
+		d.Binary = true
+		return d
+	}
+	from, to := "stash/"+rel, "dir/"+rel
+	if stashContent == nil {
+		from = "/dev/null"
+	}
+	if dirContent == nil {
+		to = "/dev/null"
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(stashContent),
+		B:        splitLines(dirContent),
+		FromFile: from,
+		ToFile:   to,
+		Context:  3,
+	})
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			d.Added++
+		case strings.HasPrefix(line, "-"):
+			d.Removed++
+		}
+	}
+	if diff == "" {
+		diff = fmt.Sprintf("files %s and %s differ in the newline at end of file\n", from, to)
+	}
+	d.Diff = diff
+	return d
+}
+
+// splitLines splits content into lines like lines does, adding a missing
+// newline at the end to keep the unified diff readable.
+func splitLines(content []byte) []string {
+	return ensureNewline(lines(content))
+}
+
+// PrintDiff writes the unified diffs, or with stat only a line per file and
+// a summary.
+func PrintDiff(w io.Writer, diffs []FileDiff, stat bool) error {
+	var added, removed, changed int
+	for _, d := range diffs {
+		switch d.Status {
+		case 'A':
+			added++
+		case 'D':
+			removed++
+		default:
+			changed++
+		}
+		var err error
+		switch {
+		case stat && d.Binary:
+			_, err = fmt.Fprintf(w, "%c %s | binary\n", d.Status, d.Path)
+		case stat:
+			_, err = fmt.Fprintf(w, "%c %s | +%d -%d\n", d.Status, d.Path, d.Added, d.Removed)
+		case d.Binary:
+			_, err = fmt.Fprintf(w, "binary files stash/%s and dir/%s differ\n", d.Path, d.Path)
+		default:
+			_, err = io.WriteString(w, d.Diff)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !stat {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "%d changed, %d added, %d removed\n", changed, added, removed)
+	return err
+}
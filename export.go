@@ -0,0 +1,106 @@
+package fstash
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+)
+
+// An exported archive holds, for each stash, its manifest and content under
+// stashes/<name>/ and the content of all the versions, once, under blobs/.
+const (
+	archiveStashes  = "stashes"
+	archiveBlobs    = "blobs"
+	archiveManifest = "manifest.json"
+	archiveContent  = "content"
+)
+
+// exportStashes writes the stashes, or all of them when names is empty, into
+// a self-contained archive. File modes and symlinks are preserved.
+func exportStashes(names []string, store Store, w io.Writer, format string) error {
+	return exportArchive(names, store, w, format, true)
+}
+
+// exportArchive is exportStashes, leaving the content of the versions out of
+// the archive unless withBlobs is set.
+func exportArchive(names []string, store Store, w io.Writer, format string, withBlobs bool) error {
+	if len(names) == 0 {
+		var err error
+		if names, err = listStashes(store); err != nil {
+			return err
+		}
+	}
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	blobs := make(map[string]bool)
+	for _, name := range names {
+		if err := exportStash(aw, polishStashName(name), store, blobs); err != nil {
+			aw.Close()
+			return err
+		}
+	}
+	if !withBlobs {
+		return aw.Close()
+	}
+	var digests []string
+	for k := range blobs {
+		digests = append(digests, k)
+	}
+	sort.Strings(digests)
+	for _, digest := range digests {
+		content, err := getBlob(store, digest)
+		if err != nil {
+			aw.Close()
+			return err
+		}
+		if err := aw.writeFile(path.Join(archiveBlobs, digest), 0644, content); err != nil {
+			aw.Close()
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+func exportStash(aw archiveWriter, stashName string, store Store, blobs map[string]bool) error {
+	m, files, err := openStash(store, stashName)
+	if err != nil {
+		return err
+	}
+	prefix := path.Join(archiveStashes, stashName)
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := aw.writeFile(path.Join(prefix, archiveManifest), 0644, content); err != nil {
+		return err
+	}
+
+	var paths []string
+	for rel := range files {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		name := path.Join(prefix, archiveContent, rel)
+		entry := files[rel]
+		if entry.isLink() {
+			if err := aw.writeSymlink(name, entry.link); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := aw.writeFile(name, entry.perm(), entry.content); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range m.Versions {
+		for _, digest := range v.Files {
+			blobs[digest] = true
+		}
+	}
+	return nil
+}
@@ -1,13 +1,26 @@
-package main
+package fstash
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -166,6 +179,10 @@ dir1 [file1.txt file2.txt]
 dir2 [file1.txt file2.txt]
 dir2/dir3 [file1.txt file2.txt]
 `, sb.String())
+
+	tree, err = readTree(filepath.Join(homeDir, "dir1", "file2.txt"))
+	require.NoError(err)
+	require.Equal(map[string][]string{".": {"file2.txt"}}, tree)
 }
 
 func Test_copyTree(t *testing.T) {
@@ -293,8 +310,8 @@ func Test_stash_directory_create_new_stash_validate_stash_name(t *testing.T) {
 	stashTree := homeDir1
 	fstashHome := homeDir3
 	stashName := "sample-stash" + "::"
-	err := createStash(stashName, stashTree, fstashHome)
-	require.Equal(errInvalidStashName, err)
+	err := createStash(stashName, stashTree, newDirStore(fstashHome))
+	require.Equal(ErrInvalidStashName, err)
 }
 
 func Test_stash_directory_create_new_stash(t *testing.T) {
@@ -313,7 +330,7 @@ func Test_stash_directory_create_new_stash(t *testing.T) {
 	stashTree := homeDir1
 	fstashHome := homeDir3
 	stashName := "sample-stash"
-	err := createStash(stashName, stashTree, fstashHome)
+	err := createStash(stashName, stashTree, newDirStore(fstashHome))
 	require.NoError(err)
 
 	parts := []string{fstashHome}
@@ -347,8 +364,8 @@ func Test_expand_stash_not_exist(t *testing.T) {
 	stashName := "sample-stash"
 	fstashHome := homeDir1
 	workingDirectory := homeDir4
-	err := expandStash(stashName, fstashHome, workingDirectory, nil)
-	require.Equal(errStashNotExist, err)
+	err := expandStash(stashName, newDirStore(fstashHome), workingDirectory, nil)
+	require.Equal(ErrStashNotExist, err)
 }
 
 func Test_expand_stash(t *testing.T) {
@@ -373,7 +390,7 @@ func Test_expand_stash(t *testing.T) {
 		stashTree := homeDir1
 		fstashHome := homeDir3
 		stashName := "sample-stash"
-		err := createStash(stashName, stashTree, fstashHome)
+		err := createStash(stashName, stashTree, newDirStore(fstashHome))
 		require.NoError(err)
 	}
 
@@ -381,7 +398,7 @@ func Test_expand_stash(t *testing.T) {
 	fstashHome := homeDir3
 	workingDirectory := homeDir4
 
-	err := expandStash(stashName, fstashHome, workingDirectory, nil)
+	err := expandStash(stashName, newDirStore(fstashHome), workingDirectory, nil)
 	require.NoError(err)
 
 	tree, err := readTree(workingDirectory)
@@ -415,19 +432,19 @@ func Test_listDepth(t *testing.T) {
 
 	{
 		stashName := "sample-stash-1"
-		err := createStash(stashName, stashTree, fstashHome)
+		err := createStash(stashName, stashTree, newDirStore(fstashHome))
 		require.NoError(err)
 	}
 
 	{
 		stashName := "sample-stash-2"
-		err := createStash(stashName, stashTree, fstashHome)
+		err := createStash(stashName, stashTree, newDirStore(fstashHome))
 		require.NoError(err)
 	}
 
 	{
 		stashName := "sample-stash-3"
-		err := createStash(stashName, stashTree, fstashHome)
+		err := createStash(stashName, stashTree, newDirStore(fstashHome))
 		require.NoError(err)
 	}
 
@@ -443,6 +460,9 @@ const (
 	templateContent = "Author of {{ .AppName }} is {{ .Author }}."
 )
 
+// sampleTemplates declares the templates of createSampleTreeWithTemplates
+var sampleTemplates = []string{"file2.txt", "file4.txt"}
+
 func createSampleTreeWithTemplates(home string) error {
 	if err := os.MkdirAll(home, 0777); err != nil {
 		return err
@@ -498,7 +518,7 @@ func Test_expand_stash_templates(t *testing.T) {
 		stashTree := homeDir1
 		fstashHome := homeDir3
 		stashName := "sample-stash"
-		err := createStash(stashName, stashTree, fstashHome)
+		err := createStashWith(stashName, []string{stashTree}, newDirStore(fstashHome), createOptions{templates: sampleTemplates})
 		require.NoError(err)
 	}
 
@@ -512,7 +532,7 @@ func Test_expand_stash_templates(t *testing.T) {
 			"file2": `{"AppName":"fstash","Author":"dc0d"}`,
 			"file4": `{"AppName":"Web","Author":"Web Developer"}`,
 		}
-		err := expandStash(stashName, fstashHome, workingDirectory, data)
+		err := expandStash(stashName, newDirStore(fstashHome), workingDirectory, data)
 		require.NoError(err)
 	}
 
@@ -562,13 +582,13 @@ func Test_deleteStash(t *testing.T) {
 		stashTree := homeDir1
 		fstashHome := homeDir3
 		stashName := "sample-stash"
-		err := createStash(stashName, stashTree, fstashHome)
+		err := createStash(stashName, stashTree, newDirStore(fstashHome))
 		require.NoError(err)
 	}
 
 	stashName := "sample-stash"
 	fstashHome := homeDir3
-	if err := deleteStash(stashName, fstashHome); err != nil {
+	if err := deleteStash(stashName, newDirStore(fstashHome)); err != nil {
 		require.NoError(err)
 	}
 
@@ -594,7 +614,7 @@ func Test_stash_directory_create_new_stash_ignore_dotgit(t *testing.T) {
 	stashTree := homeDir1
 	fstashHome := homeDir3
 	stashName := "sample-stash"
-	err := createStash(stashName, stashTree, fstashHome)
+	err := createStash(stashName, stashTree, newDirStore(fstashHome))
 	require.NoError(err)
 
 	parts := []string{fstashHome}
@@ -613,3 +633,2911 @@ dir2 [file1.txt file2.txt]
 dir2/dir3 [file1.txt file2.txt]
 `, sb.String())
 }
+
+func Test_globMatch(t *testing.T) {
+	require := require.New(t)
+
+	require.True(globMatch("*.txt", "file1.txt"))
+	require.True(globMatch("*.txt", "dir1/file1.txt"))
+	require.False(globMatch("dir1/*.txt", "dir2/file1.txt"))
+	require.True(globMatch("dir2/**", "dir2/dir3/file1.txt"))
+	require.True(globMatch("**/file2.txt", "file2.txt"))
+	require.True(globMatch("**/file2.txt", "dir2/dir3/file2.txt"))
+	require.True(globMatch("dir2/", "dir2/dir3/file2.txt"))
+	require.False(globMatch("dir2/*", "dir2/dir3/file2.txt"))
+	require.True(globMatch("file[12].txt", "file2.txt"))
+	require.False(globMatch("file[!12].txt", "file2.txt"))
+	require.False(globMatch("", "file2.txt"))
+}
+
+func Test_expand_stash_declared_templates(t *testing.T) {
+	require := require.New(t)
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "dir1", "file5.txt.tmpl"), []byte(templateContent), 0777))
+
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	err := createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{templates: []string{"dir1/file4.txt"}})
+	require.NoError(err)
+
+	m, err := readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.Equal([]string{"dir1/file4.txt"}, m.Templates)
+
+	// data for file2 is ignored as it is not a template
+	data := map[string]string{
+		"file4": `{"AppName":"Web","Author":"Web Developer"}`,
+		"file5": `{"AppName":"CLI","Author":"Gopher"}`,
+	}
+	err = expandStash(stashName, newDirStore(fstashHome), homeDir4, data)
+	require.NoError(err)
+
+	content, err := ioutil.ReadFile(filepath.Join(homeDir4, "file2.txt"))
+	require.NoError(err)
+	require.Equal(templateContent, string(content))
+
+	content, err = ioutil.ReadFile(filepath.Join(homeDir4, "dir1", "file4.txt"))
+	require.NoError(err)
+	require.Equal("Author of Web is Web Developer.", string(content))
+
+	content, err = ioutil.ReadFile(filepath.Join(homeDir4, "dir1", "file5.txt"))
+	require.NoError(err)
+	require.Equal("Author of CLI is Gopher.", string(content))
+
+	_, err = os.Stat(filepath.Join(homeDir4, "dir1", "file5.txt.tmpl"))
+	require.True(os.IsNotExist(err))
+
+	// stashes created before manifests existed render the files data is
+	// given for, as they always did
+	require.NoError(os.Remove(manifestPath(fstashHome, stashName)))
+	m, err = readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.True(m.DataTemplates)
+	data["file2"] = `{"AppName":"fstash","Author":"dc0d"}`
+	legacyDir := filepath.Join(homeDir4, "legacy")
+	require.NoError(expandStash(stashName, newDirStore(fstashHome), legacyDir, data))
+	content, err = ioutil.ReadFile(filepath.Join(legacyDir, "file2.txt"))
+	require.NoError(err)
+	require.Equal("Author of fstash is dc0d.", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(legacyDir, "file1.txt"))
+	require.NoError(err)
+	require.Equal(staticContent, string(content))
+
+	// and keep doing so once they have a manifest
+	require.NoError(expandStashWith(stashName, newDirStore(fstashHome), filepath.Join(homeDir4, "locked"), expandOptions{data: data, lock: true}))
+	m, err = readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.True(m.DataTemplates)
+	require.NoError(createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{}))
+	m, err = readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.False(m.DataTemplates)
+}
+
+func Test_create_stash_binary_template(t *testing.T) {
+	require := require.New(t)
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "logo.png"), []byte{0x89, 'P', 'N', 'G', 0, 0}, 0777))
+
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	err := createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{templates: []string{"*.png"}})
+	require.True(errors.Is(err, ErrBinaryTemplate))
+
+	// data does not make a file a template
+	require.NoError(createStash(stashName, homeDir1, newDirStore(fstashHome)))
+	require.NoError(expandStash(stashName, newDirStore(fstashHome), homeDir4, map[string]string{"logo": `{}`}))
+	content, err := ioutil.ReadFile(filepath.Join(homeDir4, "logo.png"))
+	require.NoError(err)
+	require.Equal([]byte{0x89, 'P', 'N', 'G', 0, 0}, content)
+
+	// text in another encoding is not binary, and data missing for a template
+	// is an error
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "latin1.txt"), []byte("caf\xe9 {{ .Name }}"), 0777))
+	require.NoError(createStashWith("latin", []string{homeDir1}, newDirStore(fstashHome), createOptions{templates: []string{"latin1.txt"}}))
+	err = expandStash("latin", newDirStore(fstashHome), filepath.Join(homeDir4, "latin"), nil)
+	require.Error(err)
+	require.Contains(err.Error(), "map has no entry for key")
+	require.NoError(expandStash("latin", newDirStore(fstashHome), filepath.Join(homeDir4, "latin"), map[string]string{"latin1": `{"Name":"x"}`}))
+	content, err = ioutil.ReadFile(filepath.Join(homeDir4, "latin", "latin1.txt"))
+	require.NoError(err)
+	require.Equal("caf\xe9 x", string(content))
+}
+
+func Test_expand_stash_hooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks in this test use sh")
+	}
+	require := require.New(t)
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	opts := createOptions{
+		preExpand:  []string{"test ! -e file1.txt && echo pre > pre.txt"},
+		postExpand: []string{"test -e file1.txt && echo {{ .AppName }} > post.txt"},
+	}
+	require.NoError(createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), opts))
+
+	out := new(bytes.Buffer)
+	data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+	err := expandStashWith(stashName, newDirStore(fstashHome), homeDir4, expandOptions{
+		data:   data,
+		stdout: out,
+		stderr: out,
+	})
+	require.NoError(err)
+
+	content, err := ioutil.ReadFile(filepath.Join(homeDir4, "pre.txt"))
+	require.NoError(err)
+	require.Equal("pre\n", string(content))
+
+	content, err = ioutil.ReadFile(filepath.Join(homeDir4, "post.txt"))
+	require.NoError(err)
+	require.Equal("fstash\n", string(content))
+
+	t.Run("no hooks", func(t *testing.T) {
+		dst := filepath.Join(homeDir4, "no-hooks")
+		err := expandStashWith(stashName, newDirStore(fstashHome), dst, expandOptions{noHooks: true})
+		require.NoError(err)
+		_, err = os.Stat(filepath.Join(dst, "post.txt"))
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("imported stash needs confirmation", func(t *testing.T) {
+		m, err := readManifest(newDirStore(fstashHome), stashName)
+		require.NoError(err)
+		m.Origin = "somewhere"
+		require.NoError(writeManifest(newDirStore(fstashHome), m))
+
+		dst := filepath.Join(homeDir4, "imported")
+		err = expandStashWith(stashName, newDirStore(fstashHome), dst, expandOptions{data: data})
+		require.Equal(ErrHooksNotConfirmed, err)
+
+		asked := false
+		confirm := func(m *Manifest, hooks *Hooks) bool {
+			asked = true
+			require.Equal([]string{"test -e file1.txt && echo 'fstash' > post.txt"}, hooks.PostExpand)
+			return true
+		}
+		err = expandStashWith(stashName, newDirStore(fstashHome), dst, expandOptions{data: data, confirm: confirm, stdout: out, stderr: out})
+		require.NoError(err)
+		require.True(asked)
+	})
+
+	t.Run("data is shell quoted", func(t *testing.T) {
+		dst := filepath.Join(homeDir4, "quoted")
+		hostile := map[string]string{"file2": `{"AppName":"x'; touch pwned; echo '","Author":"dc0d"}`}
+		err := expandStashWith(stashName, newDirStore(fstashHome), dst, expandOptions{data: hostile, confirm: func(*Manifest, *Hooks) bool { return true }, stdout: out, stderr: out})
+		require.NoError(err)
+		_, err = os.Stat(filepath.Join(dst, "pwned"))
+		require.True(os.IsNotExist(err))
+		content, err := ioutil.ReadFile(filepath.Join(dst, "post.txt"))
+		require.NoError(err)
+		require.Equal("x'; touch pwned; echo '\n", string(content))
+	})
+
+	t.Run("missing data", func(t *testing.T) {
+		dst := filepath.Join(homeDir4, "missing")
+		confirmed := false
+		err := expandStashWith(stashName, newDirStore(fstashHome), dst, expandOptions{
+			data:    map[string]string{"file2": `{"Author":"dc0d"}`},
+			confirm: func(*Manifest, *Hooks) bool { confirmed = true; return true },
+			stdout:  out,
+			stderr:  out,
+		})
+		require.Error(err)
+		require.Contains(err.Error(), "AppName")
+		require.False(confirmed)
+		_, err = os.Stat(dst)
+		require.True(os.IsNotExist(err))
+	})
+
+	t.Run("failing hook", func(t *testing.T) {
+		require.NoError(createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{postExpand: []string{"exit 3"}}))
+		err := expandStashWith(stashName, newDirStore(fstashHome), filepath.Join(homeDir4, "failing"), expandOptions{stdout: out, stderr: out})
+		require.Error(err)
+	})
+}
+
+func Test_parseSource(t *testing.T) {
+	require := require.New(t)
+
+	wd, err := os.Getwd()
+	require.NoError(err)
+
+	s, err := parseSource(".")
+	require.NoError(err)
+	require.Equal(Source{Path: wd}, s)
+
+	s, err = parseSource("ci:build/ci")
+	require.NoError(err)
+	require.Equal(Source{Path: filepath.Join(wd, "ci"), Dst: "build/ci"}, s)
+
+	s, err = parseSource("LICENSE:docs/")
+	require.NoError(err)
+	require.Equal(Source{Path: filepath.Join(wd, "LICENSE"), Dst: "docs/"}, s)
+
+	home, err := os.UserHomeDir()
+	require.NoError(err)
+	s, err = parseSource("~/templates/LICENSE")
+	require.NoError(err)
+	require.Equal(Source{Path: filepath.Join(home, "templates", "LICENSE")}, s)
+
+	_, err = parseSource("ci:../outside")
+	require.Equal(ErrInvalidSource, err)
+	_, err = parseSource("ci:/abs")
+	require.Equal(ErrInvalidSource, err)
+}
+
+func Test_stash_create_from_multiple_sources(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+
+	require.Nil(createSampleTree(homeDir1))
+	require.Nil(createSampleTreeWithTemplates(homeDir2))
+
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	sources := []string{
+		filepath.Join(homeDir1, "dir2"),
+		filepath.Join(homeDir2, "dir1") + ":ci",
+		filepath.Join(homeDir2, "file2.txt") + ":docs/",
+		filepath.Join(homeDir2, "file1.txt") + ":README",
+	}
+	require.NoError(createStashWith(stashName, sources, newDirStore(fstashHome), createOptions{}))
+
+	tree, err := readTree(stashDir(fstashHome, stashName))
+	require.NoError(err)
+
+	sb, err := makeOutput(tree)
+	require.NoError(err)
+
+	require.Equal(`. [README file1.txt file2.txt]
+ci [file3.txt file4.txt]
+dir3 [file1.txt file2.txt]
+docs [file2.txt]
+`, sb.String())
+
+	m, err := readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.Len(m.Sources, 4)
+	require.Equal("ci", m.Sources[1].Dst)
+}
+
+func Test_readTree_single_file(t *testing.T) {
+	require := require.New(t)
+	homeDir := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir))
+	}()
+
+	require.Nil(createSampleTree(homeDir))
+
+	tree, err := readTree(filepath.Join(homeDir, "dir1", "file2.txt"))
+	require.NoError(err)
+
+	sb, err := makeOutput(tree)
+	require.NoError(err)
+
+	require.Equal(`. [file2.txt]
+`, sb.String())
+}
+
+func Test_stash_single_files(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+	fstashHome := homeDir3
+
+	t.Run("one file", func(t *testing.T) {
+		stashName := "one-file"
+		require.NoError(createStash(stashName, filepath.Join(homeDir1, "file1.txt"), newDirStore(fstashHome)))
+
+		dst := filepath.Join(homeDir4, stashName)
+		require.NoError(expandStash(stashName, newDirStore(fstashHome), dst, nil))
+
+		tree, err := readTree(dst)
+		require.NoError(err)
+		sb, err := makeOutput(tree)
+		require.NoError(err)
+		require.Equal(`. [file1.txt]
+`, sb.String())
+	})
+
+	t.Run("list of files", func(t *testing.T) {
+		stashName := "list-of-files"
+		sources := []string{
+			filepath.Join(homeDir1, "file1.txt"),
+			filepath.Join(homeDir1, "dir1", "file4.txt"),
+		}
+		require.NoError(createStashWith(stashName, sources, newDirStore(fstashHome), createOptions{}))
+
+		dst := filepath.Join(homeDir4, stashName)
+		require.NoError(expandStash(stashName, newDirStore(fstashHome), dst, nil))
+
+		tree, err := readTree(dst)
+		require.NoError(err)
+		sb, err := makeOutput(tree)
+		require.NoError(err)
+		require.Equal(`. [file1.txt file4.txt]
+`, sb.String())
+	})
+
+	t.Run("one file from a stash", func(t *testing.T) {
+		stashName := "whole-tree"
+		require.NoError(createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{templates: sampleTemplates}))
+
+		dst := filepath.Join(homeDir4, stashName)
+		opts := expandOptions{
+			files: []string{"dir1/file4.txt"},
+			data:  map[string]string{"file4": `{"AppName":"Web","Author":"Web Developer"}`},
+		}
+		require.NoError(expandStashWith(stashName, newDirStore(fstashHome), dst, opts))
+
+		tree, err := readTree(dst)
+		require.NoError(err)
+		sb, err := makeOutput(tree)
+		require.NoError(err)
+		require.Equal(`dir1 [file4.txt]
+`, sb.String())
+
+		content, err := ioutil.ReadFile(filepath.Join(dst, "dir1", "file4.txt"))
+		require.NoError(err)
+		require.Equal("Author of Web is Web Developer.", string(content))
+
+		err = expandStashWith(stashName, newDirStore(fstashHome), dst, expandOptions{files: []string{"missing.txt"}})
+		require.True(errors.Is(err, ErrFileNotInStash))
+	})
+}
+
+func Test_expand_stash_only_exclude(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.Nil(createSampleTree(homeDir1))
+	stashName := "kitchen-sink"
+	fstashHome := homeDir3
+	require.NoError(createStash(stashName, homeDir1, newDirStore(fstashHome)))
+
+	expand := func(dst string, opts expandOptions) string {
+		require.NoError(expandStashWith(stashName, newDirStore(fstashHome), dst, opts))
+		tree, err := readTree(dst)
+		require.NoError(err)
+		sb, err := makeOutput(tree)
+		require.NoError(err)
+		return sb.String()
+	}
+
+	require.Equal(`dir2 [file1.txt file2.txt]
+dir2/dir3 [file1.txt file2.txt]
+`, expand(filepath.Join(homeDir4, "only"), expandOptions{only: []string{"dir2/**"}}))
+
+	require.Equal(`. [file1.txt]
+dir1 [file1.txt]
+dir2/dir3 [file1.txt]
+`, expand(filepath.Join(homeDir4, "both"), expandOptions{
+		only:    []string{"file1.txt"},
+		exclude: []string{"dir2/*"},
+	}))
+
+	require.Equal(`. [file1.txt file2.txt]
+`, expand(filepath.Join(homeDir4, "exclude"), expandOptions{exclude: []string{"dir*/"}}))
+
+	err := expandStashWith(stashName, newDirStore(fstashHome), filepath.Join(homeDir4, "none"), expandOptions{only: []string{"*.go"}})
+	require.Equal(ErrNoFilesSelected, err)
+}
+
+func Test_diffStash(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	require.NoError(createStash(stashName, homeDir1, newDirStore(fstashHome)))
+
+	data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+	require.NoError(expandStash(stashName, newDirStore(fstashHome), homeDir4, data))
+
+	diffs, err := diffStash(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data})
+	require.NoError(err)
+	require.Len(diffs, 0)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir4, "file1.txt"), []byte("changed content"), 0777))
+	require.NoError(os.Remove(filepath.Join(homeDir4, "dir1", "file3.txt")))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir4, "go.mod"), []byte("module x\n"), 0777))
+
+	diffs, err = diffStash(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data})
+	require.NoError(err)
+
+	out := new(bytes.Buffer)
+	require.NoError(PrintDiff(out, diffs, true))
+	require.Equal(`D dir1/file3.txt | +0 -1
+M file1.txt | +1 -1
+A go.mod | +1 -0
+1 changed, 1 added, 1 removed
+`, out.String())
+
+	out.Reset()
+	require.NoError(PrintDiff(out, diffs[1:2], false))
+	require.Equal(`--- stash/file1.txt
++++ dir/file1.txt
+@@ -1 +1 @@
+-some static content
++changed content
+`, out.String())
+
+	diffs, err = diffStash(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data, only: []string{"dir1/"}})
+	require.NoError(err)
+	require.Len(diffs, 1)
+	require.Equal("dir1/file3.txt", diffs[0].Path)
+}
+
+func Test_merge3(t *testing.T) {
+	require := require.New(t)
+
+	base := lines([]byte("a\nb\nc\nd\ne\n"))
+
+	merged, conflict := merge3(base, lines([]byte("a\nB\nc\nd\ne\n")), lines([]byte("a\nb\nc\nD\ne\nf\n")), "ours", "theirs")
+	require.False(conflict)
+	require.Equal("a\nB\nc\nD\ne\nf\n", strings.Join(merged, ""))
+
+	merged, conflict = merge3(base, lines([]byte("a\nB\nc\nd\ne\n")), lines([]byte("a\nX\nc\nd\ne\n")), "ours", "theirs")
+	require.True(conflict)
+	require.Equal("a\n<<<<<<< ours\nB\n=======\nX\n>>>>>>> theirs\nc\nd\ne\n", strings.Join(merged, ""))
+
+	merged, conflict = merge3(base, lines([]byte("a\nc\nd\ne\n")), lines([]byte("a\nc\nd\ne\n")), "ours", "theirs")
+	require.False(conflict)
+	require.Equal("a\nc\nd\ne\n", strings.Join(merged, ""))
+}
+
+func Test_upgradeDir(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	write := func(fp, content string) {
+		require.NoError(os.MkdirAll(filepath.Dir(fp), 0777))
+		require.NoError(ioutil.WriteFile(fp, []byte(content), 0777))
+	}
+	read := func(fp string) string {
+		content, err := ioutil.ReadFile(fp)
+		require.NoError(err)
+		return string(content)
+	}
+
+	write(filepath.Join(homeDir1, "README.md.tmpl"), "# {{ .AppName }}\n\nintro\n\nusage\n")
+	write(filepath.Join(homeDir1, "Makefile"), "build:\n\tgo build\n")
+	write(filepath.Join(homeDir1, "ci.yml"), "steps:\n  - test\n")
+	write(filepath.Join(homeDir1, "old.txt"), "old\n")
+
+	stashName := "skeleton"
+	fstashHome := homeDir3
+	require.NoError(createStash(stashName, homeDir1, newDirStore(fstashHome)))
+
+	data := map[string]string{"README": `{"AppName":"fstash"}`}
+	require.NoError(expandStashWith(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data, lock: true}))
+
+	l, err := readLockFile(homeDir4)
+	require.NoError(err)
+	require.Equal("skeleton", l.Stash)
+	require.Equal("1", l.Version)
+
+	// changes in the project
+	write(filepath.Join(homeDir4, "README.md"), "# fstash\n\nintro\n\nusage: fstash expand\n")
+	write(filepath.Join(homeDir4, "ci.yml"), "steps:\n  - lint\n")
+
+	// changes in the stash
+	write(filepath.Join(homeDir1, "README.md.tmpl"), "# {{ .AppName }}\n\nbetter intro\n\nusage\n")
+	write(filepath.Join(homeDir1, "Makefile"), "build:\n\tgo build ./...\n")
+	write(filepath.Join(homeDir1, "ci.yml"), "steps:\n  - build\n")
+	write(filepath.Join(homeDir1, "LICENSE"), "MIT\n")
+	require.NoError(os.Chmod(filepath.Join(homeDir1, "LICENSE"), 0640))
+	require.NoError(os.Remove(filepath.Join(homeDir1, "old.txt")))
+	_, err = updateStash(stashName, newDirStore(fstashHome), "2.0.0")
+	require.NoError(err)
+	require.NoError(os.Chmod(filepath.Join(homeDir4, "Makefile"), 0600))
+
+	changes, err := upgradeDir(newDirStore(fstashHome), homeDir4, upgradeOptions{})
+	require.NoError(err)
+	require.Equal([]FileChange{
+		{"LICENSE", "added"},
+		{"Makefile", "updated"},
+		{"README.md", "merged"},
+		{"ci.yml", "conflict"},
+		{"old.txt", "deleted"},
+	}, changes)
+
+	require.Equal("MIT\n", read(filepath.Join(homeDir4, "LICENSE")))
+	require.Equal("build:\n\tgo build ./...\n", read(filepath.Join(homeDir4, "Makefile")))
+	// new files get the mode of the stash, the others keep theirs
+	for name, mode := range map[string]os.FileMode{"LICENSE": 0640, "Makefile": 0600} {
+		info, err := os.Stat(filepath.Join(homeDir4, name))
+		require.NoError(err)
+		require.Equal(mode, info.Mode().Perm(), name)
+	}
+	require.Equal("# fstash\n\nbetter intro\n\nusage: fstash expand\n", read(filepath.Join(homeDir4, "README.md")))
+	require.Equal("steps:\n<<<<<<< ours\n  - lint\n=======\n  - build\n>>>>>>> stash skeleton 2.0.0\n", read(filepath.Join(homeDir4, "ci.yml")))
+	_, err = os.Stat(filepath.Join(homeDir4, "old.txt"))
+	require.True(os.IsNotExist(err))
+
+	l, err = readLockFile(homeDir4)
+	require.NoError(err)
+	require.Equal("2.0.0", l.Version)
+
+	_, err = upgradeDir(newDirStore(fstashHome), homeDir4, upgradeOptions{version: "3"})
+	require.Equal(ErrVersionNotExist, err)
+
+	// a stash created again is not the one the directory came from
+	require.NoError(deleteStash(stashName, newDirStore(fstashHome)))
+	write(filepath.Join(homeDir1, "LICENSE"), "BSD\n")
+	require.NoError(createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{version: "2.0.0"}))
+	_, err = upgradeDir(newDirStore(fstashHome), homeDir4, upgradeOptions{})
+	require.True(errors.Is(err, ErrVersionChanged))
+	require.Equal("MIT\n", read(filepath.Join(homeDir4, "LICENSE")))
+
+	// a version with paths out of the directory writes nothing
+	project := filepath.Join(homeDir4, "project")
+	require.NoError(expandStashWith(stashName, newDirStore(fstashHome), project, expandOptions{data: data, lock: true}))
+	m, err := readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	blob, err := putBlob(newDirStore(fstashHome), []byte("escaped\n"))
+	require.NoError(err)
+	files := map[string]string{"../../escaped.txt": blob, "LICENSE": blob}
+	m.Versions = append(m.Versions, Version{Version: "evil", Digest: filesDigest(files, nil), Files: files})
+	require.NoError(writeManifest(newDirStore(fstashHome), m))
+	_, err = upgradeDir(newDirStore(fstashHome), project, upgradeOptions{version: "evil"})
+	require.True(errors.Is(err, ErrInvalidArchive))
+	_, err = os.Stat(filepath.Join(project, "..", "..", "escaped.txt"))
+	require.True(os.IsNotExist(err))
+	require.Equal("BSD\n", read(filepath.Join(project, "LICENSE")))
+
+	_, err = upgradeDir(newDirStore(fstashHome), homeDir1, upgradeOptions{})
+	require.Equal(ErrNoLockFile, err)
+}
+
+func Test_upgradeDir_secrets(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.NoError(os.MkdirAll(homeDir1, 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "env.tmpl"), []byte("TOKEN={{ .Token }}\n"), 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "Makefile"), []byte("build:\n"), 0777))
+	stashName := "secrets"
+	fstashHome := homeDir3
+	require.NoError(createStash(stashName, homeDir1, newDirStore(fstashHome)))
+
+	data := map[string]string{"env": `{"Token":"t0k3n"}`}
+	require.NoError(expandStashWith(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data, lock: true}))
+
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "Makefile"), []byte("build:\n\tgo build\n"), 0777))
+	_, err := updateStash(stashName, newDirStore(fstashHome), "")
+	require.NoError(err)
+
+	_, err = upgradeDir(newDirStore(fstashHome), homeDir4, upgradeOptions{})
+	require.True(errors.Is(err, ErrSecretsMissing))
+
+	changes, err := upgradeDir(newDirStore(fstashHome), homeDir4, upgradeOptions{data: data})
+	require.NoError(err)
+	require.Equal([]FileChange{{"Makefile", "updated"}}, changes)
+}
+
+func Test_redactSecrets(t *testing.T) {
+	require := require.New(t)
+
+	data := map[string]string{
+		"config":    `{"AppName":"fstash","DBPassword":"123","Deploy":{"Host":"h","Token":"t"},"Signing":"k"}`,
+		"variables": `{"Author":"Kaveh"}`,
+	}
+	redacted, names, err := redactSecrets(data, []string{"signing"})
+	require.NoError(err)
+	require.Equal(map[string]string{
+		"config":    `{"AppName":"fstash","Deploy":{"Host":"h"}}`,
+		"variables": `{"Author":"Kaveh"}`,
+	}, redacted)
+	require.Equal([]string{"DBPassword", "Signing", "Token"}, names)
+	require.Contains(data["config"], "DBPassword")
+}
+
+func Test_lockStatus(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	require.NoError(createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{templates: []string{"file2.txt"}}))
+
+	data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d","Token":"secret"}`}
+	require.NoError(expandStashWith(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data, lock: true}))
+
+	l, err := readLockFile(homeDir4)
+	require.NoError(err)
+	require.Equal(`{"AppName":"fstash","Author":"dc0d"}`, l.Data["file2"])
+	require.Equal([]string{"Token"}, l.Redacted)
+	require.Len(l.Files, 4)
+	require.Equal(digestOf([]byte("Author of fstash is dc0d.")), l.Files["file2.txt"])
+
+	err = expandStashWith(stashName, newDirStore(fstashHome), filepath.Join(homeDir4, "partial"), expandOptions{data: data, lock: true, only: []string{"dir1/**"}})
+	require.True(errors.Is(err, ErrPartialLock))
+
+	changes, err := lockStatus(homeDir4)
+	require.NoError(err)
+	require.Len(changes, 0)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir4, "file1.txt"), []byte("changed"), 0777))
+	require.NoError(os.Remove(filepath.Join(homeDir4, "dir1", "file4.txt")))
+
+	changes, err = lockStatus(homeDir4)
+	require.NoError(err)
+	require.Equal([]FileChange{
+		{"dir1/file4.txt", "deleted"},
+		{"file1.txt", "modified"},
+	}, changes)
+
+	// the lock file does not show up as a difference
+	diffs, err := diffStash(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data})
+	require.NoError(err)
+	require.Len(diffs, 2)
+}
+
+func Test_updateStash(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+
+	require.Nil(createSampleTree(homeDir1))
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	require.NoError(createStashWith(stashName, []string{homeDir1}, newDirStore(fstashHome), createOptions{templates: []string{"dir1/*"}}))
+
+	changes, err := updateStash(stashName, newDirStore(fstashHome), "")
+	require.NoError(err)
+	require.Len(changes, 0)
+
+	require.NoError(os.RemoveAll(filepath.Join(homeDir1, "dir2")))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "file1.txt"), []byte("changed"), 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "dir1", "file3.txt"), []byte("new"), 0777))
+
+	changes, err = updateStash(stashName, newDirStore(fstashHome), "")
+	require.NoError(err)
+	require.Equal([]FileChange{
+		{"dir1/file3.txt", "added"},
+		{"dir2/dir3/file1.txt", "removed"},
+		{"dir2/dir3/file2.txt", "removed"},
+		{"dir2/file1.txt", "removed"},
+		{"dir2/file2.txt", "removed"},
+		{"file1.txt", "changed"},
+	}, changes)
+
+	tree, err := readTree(stashDir(fstashHome, stashName))
+	require.NoError(err)
+	sb, err := makeOutput(tree)
+	require.NoError(err)
+	require.Equal(`. [file1.txt file2.txt]
+dir1 [file1.txt file2.txt file3.txt]
+`, sb.String())
+
+	m, err := readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.Equal("2", m.Version)
+	require.Len(m.Versions, 2)
+	require.Equal([]string{"dir1/file1.txt", "dir1/file2.txt", "dir1/file3.txt"}, m.Templates)
+
+	// a failing update leaves the stash as it was
+	require.NoError(os.Remove(filepath.Join(homeDir1, "dir1", "file3.txt")))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "dir1", "logo.png"), []byte{0x89, 'P', 'N', 'G', 0}, 0777))
+	_, err = updateStash(stashName, newDirStore(fstashHome), "")
+	require.True(errors.Is(err, ErrBinaryTemplate))
+	tree, err = readTree(stashDir(fstashHome, stashName))
+	require.NoError(err)
+	sb, err = makeOutput(tree)
+	require.NoError(err)
+	require.Equal(`. [file1.txt file2.txt]
+dir1 [file1.txt file2.txt file3.txt]
+`, sb.String())
+	m, err = readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.Equal("2", m.Version)
+	require.NoError(os.Remove(filepath.Join(homeDir1, "dir1", "logo.png")))
+
+	require.NoError(createStash("no-sources", homeDir1, newDirStore(fstashHome)))
+	m, err = readManifest(newDirStore(fstashHome), "no-sources")
+	require.NoError(err)
+	m.Sources = nil
+	require.NoError(writeManifest(newDirStore(fstashHome), m))
+	_, err = updateStash("no-sources", newDirStore(fstashHome), "")
+	require.Equal(ErrNoSources, err)
+}
+
+func Test_captureFiles(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+	stashName := "sample-stash"
+	fstashHome := homeDir3
+	require.NoError(createStash(stashName, homeDir1, newDirStore(fstashHome)))
+
+	data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+	require.NoError(expandStashWith(stashName, newDirStore(fstashHome), homeDir4, expandOptions{data: data, lock: true}))
+
+	require.NoError(os.MkdirAll(filepath.Join(homeDir4, "ci"), 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir4, "ci", "build.yml"), []byte("build fstash by dc0d, {{ literal }}\n"), 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir4, "file2.txt"), []byte("Author of fstash is dc0d!"), 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir4, "file1.txt"), []byte("not captured"), 0777))
+	require.NoError(os.Chmod(filepath.Join(homeDir4, "ci", "build.yml"), 0640))
+
+	changes, err := captureFiles("", newDirStore(fstashHome), homeDir4, captureOptions{
+		paths:      []string{"ci/", "file2.txt"},
+		templatize: true,
+	})
+	require.NoError(err)
+	require.Equal([]FileChange{
+		{"ci/build.yml", "added"},
+		{"file2.txt", "changed"},
+	}, changes)
+
+	dir := stashDir(fstashHome, stashName)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "ci", "build.yml"))
+	require.NoError(err)
+	require.Equal("build {{ .AppName }} by {{ .Author }}, {{\"{{\"}} literal }}\n", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(dir, "file1.txt"))
+	require.NoError(err)
+	require.Equal(staticContent, string(content))
+
+	m, err := readManifest(newDirStore(fstashHome), stashName)
+	require.NoError(err)
+	require.Equal("2", m.Version)
+	require.Equal([]string{"ci/build.yml", "file2.txt"}, m.Templates)
+	// captured files keep their modes, in the stash and in the version
+	info, err := os.Stat(filepath.Join(dir, "ci", "build.yml"))
+	require.NoError(err)
+	require.Equal(os.FileMode(0640), info.Mode().Perm())
+	require.Equal(os.FileMode(0640), m.findVersion("2").Modes["ci/build.yml"])
+
+	// expanding the new version gives back the captured files
+	dst := filepath.Join(homeDir4, "again")
+	data["build"] = data["file2"]
+	require.NoError(expandStash(stashName, newDirStore(fstashHome), dst, data))
+	content, err = ioutil.ReadFile(filepath.Join(dst, "ci", "build.yml"))
+	require.NoError(err)
+	require.Equal("build fstash by dc0d, {{ literal }}\n", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(dst, "file2.txt"))
+	require.NoError(err)
+	require.Equal("Author of fstash is dc0d!", string(content))
+
+	// without templatize values stay literal, while the file is still a template
+	changes, err = captureFiles(stashName, newDirStore(fstashHome), homeDir4, captureOptions{paths: []string{"ci/"}, version: "literal"})
+	require.NoError(err)
+	require.Equal([]FileChange{{"ci/build.yml", "changed"}}, changes)
+	content, err = ioutil.ReadFile(filepath.Join(dir, "ci", "build.yml"))
+	require.NoError(err)
+	require.Equal("build fstash by dc0d, {{\"{{\"}} literal }}\n", string(content))
+}
+
+func Test_renameStash(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+
+	require.Nil(createSampleTree(homeDir1))
+	fstashHome := homeDir3
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(fstashHome)))
+	require.NoError(createStash("other-stash", homeDir1, newDirStore(fstashHome)))
+
+	require.Equal(ErrStashExists, renameStash("sample-stash", "other-stash", newDirStore(fstashHome)))
+	require.Equal(ErrStashNotExist, renameStash("missing", "new-name", newDirStore(fstashHome)))
+	require.Equal(ErrInvalidStashName, renameStash("sample-stash", "new:name", newDirStore(fstashHome)))
+
+	require.NoError(renameStash("sample-stash", "New-Name", newDirStore(fstashHome)))
+
+	l, err := listDepth(fstashHome, 5)
+	require.NoError(err)
+	sort.Strings(l)
+	require.Equal([]string{"new-name", "other-stash"}, l)
+
+	_, err = os.Stat(manifestPath(fstashHome, "sample-stash"))
+	require.True(os.IsNotExist(err))
+	m, err := readManifest(newDirStore(fstashHome), "new-name")
+	require.NoError(err)
+	require.Equal("new-name", m.Name)
+	require.Equal("1", m.Version)
+
+	tree, err := readTree(stashDir(fstashHome, "new-name"))
+	require.NoError(err)
+	sb, err := makeOutput(tree)
+	require.NoError(err)
+	require.Equal(`. [file1.txt file2.txt]
+dir1 [file1.txt file2.txt]
+dir2 [file1.txt file2.txt]
+dir2/dir3 [file1.txt file2.txt]
+`, sb.String())
+}
+
+func Test_copyStash(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.Nil(createSampleTreeWithTemplates(homeDir1))
+	fstashHome := homeDir3
+	require.NoError(createStashWith("sample-stash", []string{homeDir1}, newDirStore(fstashHome), createOptions{templates: []string{"file2.txt"}}))
+
+	require.Equal(ErrStashExists, copyStash("sample-stash", "sample-stash", newDirStore(fstashHome)))
+	require.NoError(copyStash("sample-stash", "sample-copy", newDirStore(fstashHome)))
+
+	l, err := listDepth(fstashHome, 5)
+	require.NoError(err)
+	sort.Strings(l)
+	require.Equal([]string{"sample-copy", "sample-stash"}, l)
+
+	m, err := readManifest(newDirStore(fstashHome), "sample-copy")
+	require.NoError(err)
+	require.Equal("sample-copy", m.Name)
+	require.Equal([]string{"file2.txt"}, m.Templates)
+	require.Len(m.Versions, 1)
+
+	data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+	require.NoError(expandStash("sample-copy", newDirStore(fstashHome), homeDir4, data))
+	content, err := ioutil.ReadFile(filepath.Join(homeDir4, "file2.txt"))
+	require.NoError(err)
+	require.Equal("Author of fstash is dc0d.", string(content))
+}
+
+func createSampleTreeWithModes(home string) error {
+	if err := createSampleTreeWithTemplates(home); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, "build.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(filepath.Join(home, "build.sh"), 0755); err != nil {
+		return err
+	}
+	return os.Symlink("file1.txt", filepath.Join(home, "link.txt"))
+}
+
+func Test_stash_keeps_modes_and_symlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes and symlinks")
+	}
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.NoError(createSampleTreeWithModes(homeDir1))
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(homeDir3)))
+	require.NoError(expandStash("sample-stash", newDirStore(homeDir3), homeDir4, nil))
+
+	info, err := os.Lstat(filepath.Join(homeDir4, "build.sh"))
+	require.NoError(err)
+	require.Equal(os.FileMode(0755), info.Mode().Perm())
+
+	target, err := os.Readlink(filepath.Join(homeDir4, "link.txt"))
+	require.NoError(err)
+	require.Equal("file1.txt", target)
+
+	// versions keep symlinks as symlinks, not the content they point to
+	m, err := readManifest(newDirStore(homeDir3), "sample-stash")
+	require.NoError(err)
+	v := m.findVersion(m.Version)
+	require.Equal(map[string]string{"link.txt": "file1.txt"}, v.Links)
+	require.NotContains(v.Files, "link.txt")
+}
+
+func Test_writeEntries_symlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks")
+	}
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+
+	file := func(content string) *archiveEntry {
+		return &archiveEntry{mode: 0644, content: []byte(content)}
+	}
+	link := func(target string) *archiveEntry {
+		return &archiveEntry{mode: os.ModeSymlink | 0777, link: target}
+	}
+
+	for _, entries := range []map[string]*archiveEntry{
+		{"passwd": link("/etc/passwd")},
+		{"dir/up": link("../../outside")},
+		{"up": link("dir/../../outside")},
+		{"dir": link("."), "dir/file.txt": file("through the link")},
+		{"out": link(".."), "out/file.txt": file("outside")},
+		{"../outside.txt": file("outside")},
+		{"dir/../../outside.txt": file("outside")},
+	} {
+		dst := filepath.Join(homeDir1, randTemp())
+		err := writeEntries(entries, dst)
+		require.True(errors.Is(err, ErrInvalidArchive), "%v", err)
+		_, err = os.Stat(dst)
+		require.True(os.IsNotExist(err))
+	}
+
+	dst := filepath.Join(homeDir1, "ok")
+	require.NoError(writeEntries(map[string]*archiveEntry{
+		"a.txt":       link("dir/b.txt"),
+		"dir/b.txt":   file("b"),
+		"dir/up.txt":  link("../a.txt"),
+		"dir/c/d.txt": file("d"),
+	}, dst))
+	content, err := ioutil.ReadFile(filepath.Join(dst, "dir", "up.txt"))
+	require.NoError(err)
+	require.Equal("b", string(content))
+}
+
+func Test_exportStashes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes and symlinks")
+	}
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+
+	require.NoError(createSampleTreeWithModes(homeDir1))
+	fstashHome := homeDir3
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(fstashHome)))
+	require.NoError(createStash("other-stash", filepath.Join(homeDir1, "dir1"), newDirStore(fstashHome)))
+
+	blob := "blobs/" + digestOf([]byte(staticContent))
+
+	t.Run("tar.gz", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		require.NoError(exportStashes([]string{"sample-stash"}, newDirStore(fstashHome), buf, FormatTarGz))
+
+		gz, err := gzip.NewReader(buf)
+		require.NoError(err)
+		tr := tar.NewReader(gz)
+		entries := make(map[string]*tar.Header)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			entries[hdr.Name] = hdr
+		}
+		require.Len(entries, 10)
+		require.Contains(entries, "stashes/sample-stash/manifest.json")
+		require.Contains(entries, "stashes/sample-stash/content/dir1/file4.txt")
+		require.Contains(entries, blob)
+		require.Equal(int64(0755), entries["stashes/sample-stash/content/build.sh"].Mode)
+		require.Equal(byte(tar.TypeSymlink), entries["stashes/sample-stash/content/link.txt"].Typeflag)
+		require.Equal("file1.txt", entries["stashes/sample-stash/content/link.txt"].Linkname)
+	})
+
+	t.Run("zip of all", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		require.NoError(exportStashes(nil, newDirStore(fstashHome), buf, FormatZip))
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(err)
+		entries := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			entries[f.Name] = f
+		}
+		require.Contains(entries, "stashes/sample-stash/manifest.json")
+		require.Contains(entries, "stashes/other-stash/content/file3.txt")
+		require.Contains(entries, blob)
+		require.Equal(os.FileMode(0755), entries["stashes/sample-stash/content/build.sh"].Mode().Perm())
+		require.True(entries["stashes/sample-stash/content/link.txt"].Mode()&os.ModeSymlink != 0)
+	})
+
+	require.Equal(ErrStashNotExist, exportStashes([]string{"missing"}, newDirStore(fstashHome), ioutil.Discard, FormatZip))
+}
+
+func Test_importStashes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes and symlinks")
+	}
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.NoError(createSampleTreeWithModes(homeDir1))
+	require.NoError(createStashWith("sample-stash", []string{homeDir1}, newDirStore(homeDir3), createOptions{
+		postExpand: []string{"touch done"},
+	}))
+	require.NoError(createStash("other-stash", filepath.Join(homeDir1, "dir1"), newDirStore(homeDir3)))
+	require.NoError(os.MkdirAll(homeDir2, 0777))
+	data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+
+	for _, format := range []string{FormatTarGz, FormatZip} {
+		buf := new(bytes.Buffer)
+		require.NoError(exportStashes(nil, newDirStore(homeDir3), buf, format))
+		archive := filepath.Join(homeDir2, "stashes."+format)
+		require.NoError(ioutil.WriteFile(archive, buf.Bytes(), 0644))
+
+		fstashHome := filepath.Join(homeDir4, format)
+		names, err := importStashes(context.Background(), archive, newDirStore(fstashHome), importOptions{})
+		require.NoError(err)
+		require.Equal([]string{"other-stash", "sample-stash"}, names)
+
+		m, err := readManifest(newDirStore(fstashHome), "sample-stash")
+		require.NoError(err)
+		require.Equal(archive, m.Origin)
+		require.Len(m.Versions, 1)
+		require.Equal("1", m.Version)
+		require.Equal([]string{"touch done"}, m.Hooks.PostExpand)
+
+		dst := filepath.Join(homeDir2, "expanded-"+format)
+		err = expandStashWith("sample-stash", newDirStore(fstashHome), dst, expandOptions{
+			data:    data,
+			confirm: func(*Manifest, *Hooks) bool { return false },
+		})
+		require.True(errors.Is(err, ErrHooksNotConfirmed))
+		require.NoError(expandStashWith("sample-stash", newDirStore(fstashHome), dst, expandOptions{
+			data:    data,
+			noHooks: true,
+		}))
+		info, err := os.Lstat(filepath.Join(dst, "build.sh"))
+		require.NoError(err)
+		require.Equal(os.FileMode(0755), info.Mode().Perm())
+		target, err := os.Readlink(filepath.Join(dst, "link.txt"))
+		require.NoError(err)
+		require.Equal("file1.txt", target)
+	}
+
+	archive := filepath.Join(homeDir2, "stashes."+FormatTarGz)
+	fstashHome := filepath.Join(homeDir4, FormatTarGz)
+
+	t.Run("conflicts", func(t *testing.T) {
+		_, err := importStashes(context.Background(), archive, newDirStore(fstashHome), importOptions{})
+		require.True(errors.Is(err, ErrStashExists))
+
+		names, err := importStashes(context.Background(), archive, newDirStore(fstashHome), importOptions{onConflict: ConflictRename})
+		require.NoError(err)
+		require.Equal([]string{"other-stash-2", "sample-stash-2"}, names)
+
+		names, err = importStashes(context.Background(), archive, newDirStore(fstashHome), importOptions{name: "renamed", onConflict: ConflictRename})
+		require.Equal(ErrImportName, err)
+		require.Nil(names)
+
+		names, err = importStashes(context.Background(), archive, newDirStore(fstashHome), importOptions{onConflict: ConflictVersion})
+		require.NoError(err)
+		require.Equal([]string{"other-stash", "sample-stash"}, names)
+		m, err := readManifest(newDirStore(fstashHome), "sample-stash")
+		require.NoError(err)
+		require.Len(m.Versions, 2)
+		require.Equal("2", m.Version)
+		require.Equal(m.Versions[0].Digest, m.Versions[1].Digest)
+
+		_, err = importStashes(context.Background(), archive, newDirStore(fstashHome), importOptions{onConflict: "overwrite"})
+		require.Equal(ErrUnknownConflict, err)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		aw, err := newArchiveWriter(buf, FormatTarGz)
+		require.NoError(err)
+		require.NoError(aw.writeFile("stashes/tampered/manifest.json", 0644, []byte(`{"name":"tampered"}`)))
+		require.NoError(aw.writeFile("blobs/"+digestOf([]byte("original")), 0644, []byte("changed")))
+		require.NoError(aw.Close())
+		tampered := filepath.Join(homeDir2, "tampered.tar.gz")
+		require.NoError(ioutil.WriteFile(tampered, buf.Bytes(), 0644))
+		_, err = importStashes(context.Background(), tampered, newDirStore(fstashHome), importOptions{})
+		require.True(errors.Is(err, ErrInvalidArchive))
+
+		// an older version with a path out of the stash, and a valid digest
+		blob := []byte("escaped")
+		evil := map[string]string{"../../escaped.txt": digestOf(blob)}
+		current := map[string]string{"a.txt": digestOf(blob)}
+		manifest, err := json.Marshal(&Manifest{Name: "evil", Version: "1", Versions: []Version{
+			{Version: "1", Digest: filesDigest(current, nil), Files: current},
+			{Version: "2", Digest: filesDigest(evil, nil), Files: evil},
+		}})
+		require.NoError(err)
+		buf.Reset()
+		aw, err = newArchiveWriter(buf, FormatTarGz)
+		require.NoError(err)
+		require.NoError(aw.writeFile("stashes/evil/manifest.json", 0644, manifest))
+		require.NoError(aw.writeFile("stashes/evil/content/a.txt", 0644, blob))
+		require.NoError(aw.writeFile("blobs/"+digestOf(blob), 0644, blob))
+		require.NoError(aw.Close())
+		tampered = filepath.Join(homeDir2, "evil.tar.gz")
+		require.NoError(ioutil.WriteFile(tampered, buf.Bytes(), 0644))
+		_, err = importStashes(context.Background(), tampered, newDirStore(fstashHome), importOptions{})
+		require.True(errors.Is(err, ErrInvalidArchive))
+		_, err = os.Stat(stashDir(fstashHome, "evil"))
+		require.True(os.IsNotExist(err))
+
+		buf.Reset()
+		aw, err = newArchiveWriter(buf, FormatZip)
+		require.NoError(err)
+		require.NoError(aw.writeFile("../escape.txt", 0644, []byte("content")))
+		require.NoError(aw.Close())
+		tampered = filepath.Join(homeDir2, "tampered.zip")
+		require.NoError(ioutil.WriteFile(tampered, buf.Bytes(), 0644))
+		_, err = importStashes(context.Background(), tampered, newDirStore(fstashHome), importOptions{})
+		require.True(errors.Is(err, ErrInvalidArchive))
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		names, err := importStashes(context.Background(), filepath.Join(homeDir1, "dir1"), newDirStore(fstashHome), importOptions{name: "from-dir"})
+		require.NoError(err)
+		require.Equal([]string{"from-dir"}, names)
+		m, content, err := openStash(newDirStore(fstashHome), "from-dir")
+		require.NoError(err)
+		require.Equal(filepath.Join(homeDir1, "dir1"), m.Origin)
+		require.Equal("1", m.Version)
+		require.Contains(content, "file3.txt")
+	})
+
+	t.Run("git", func(t *testing.T) {
+		if _, err := exec.LookPath("git"); err != nil {
+			t.Skip("git is not installed")
+		}
+		repo := filepath.Join(homeDir2, "repo")
+		require.NoError(os.MkdirAll(filepath.Join(repo, "skeleton"), 0777))
+		require.NoError(ioutil.WriteFile(filepath.Join(repo, "skeleton", "main.go"), []byte("package main\n"), 0644))
+		git := func(args ...string) {
+			cmd := exec.Command("git", append([]string{"-C", repo,
+				"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+			out, err := cmd.CombinedOutput()
+			require.NoError(err, string(out))
+		}
+		git("init", "-q")
+		git("add", ".")
+		git("commit", "-q", "-m", "skeleton")
+		git("tag", "v1")
+		require.NoError(ioutil.WriteFile(filepath.Join(repo, "skeleton", "main.go"), []byte("package changed\n"), 0644))
+		git("commit", "-q", "-a", "-m", "changed")
+
+		names, err := importStashes(context.Background(), repo, newDirStore(fstashHome), importOptions{ref: "v1", subdir: "skeleton"})
+		require.NoError(err)
+		require.Equal([]string{"repo"}, names)
+		m, _, err := openStash(newDirStore(fstashHome), "repo")
+		require.NoError(err)
+		dir := stashDir(fstashHome, "repo")
+		require.Equal(repo+"@v1", m.Origin)
+		content, err := ioutil.ReadFile(filepath.Join(dir, "main.go"))
+		require.NoError(err)
+		require.Equal("package main\n", string(content))
+
+		_, err = importStashes(context.Background(), repo, newDirStore(fstashHome), importOptions{ref: "missing", name: "missing"})
+		require.Error(err)
+	})
+}
+
+func Test_server(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(homeDir3)))
+
+	ts := httptest.NewServer(newServer(newDirStore(homeDir3), "secret"))
+	defer ts.Close()
+
+	do := func(method, path, token string, body []byte) (int, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		require.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer res.Body.Close()
+		content, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		return res.StatusCode, content
+	}
+
+	status, _ := do(http.MethodGet, "/stashes", "", nil)
+	require.Equal(http.StatusUnauthorized, status)
+	status, _ = do(http.MethodGet, "/stashes", "wrong", nil)
+	require.Equal(http.StatusUnauthorized, status)
+
+	status, body := do(http.MethodGet, "/stashes", "secret", nil)
+	require.Equal(http.StatusOK, status)
+	require.JSONEq(`["sample-stash"]`, string(body))
+
+	status, body = do(http.MethodGet, "/stashes/sample-stash", "secret", nil)
+	require.Equal(http.StatusOK, status)
+	m := &Manifest{}
+	require.NoError(json.Unmarshal(body, m))
+	require.Equal("sample-stash", m.Name)
+	require.Equal("1", m.Version)
+
+	status, _ = do(http.MethodGet, "/stashes/missing", "secret", nil)
+	require.Equal(http.StatusNotFound, status)
+	status, _ = do(http.MethodGet, "/stashes/..", "secret", nil)
+	require.Equal(http.StatusBadRequest, status)
+	status, _ = do(http.MethodDelete, "/stashes/sample-stash", "secret", nil)
+	require.Equal(http.StatusMethodNotAllowed, status)
+
+	status, archive := do(http.MethodGet, "/stashes/sample-stash/archive", "secret", nil)
+	require.Equal(http.StatusOK, status)
+	entries, err := readArchive(archive)
+	require.NoError(err)
+	require.Equal([]string{"sample-stash"}, archivedStashes(entries))
+	status, archive = do(http.MethodGet, "/stashes/sample-stash/archive?format=zip", "secret", nil)
+	require.Equal(http.StatusOK, status)
+	require.True(bytes.HasPrefix(archive, []byte("PK")))
+
+	// a new version, made elsewhere, goes back up
+	fstashHome := homeDir4
+	names, err := importEntries(entries, "", newDirStore(fstashHome), importOptions{})
+	require.NoError(err)
+	require.Equal([]string{"sample-stash"}, names)
+	require.NoError(ioutil.WriteFile(filepath.Join(stashDir(fstashHome, "sample-stash"), "file1.txt"), []byte("changed"), 0644))
+	lm, _, err := openStash(newDirStore(fstashHome), "sample-stash")
+	require.NoError(err)
+	require.NoError(snapshotStash(newDirStore(fstashHome), lm, ""))
+	require.NoError(writeManifest(newDirStore(fstashHome), lm))
+	buf := new(bytes.Buffer)
+	require.NoError(exportStashes([]string{"sample-stash"}, newDirStore(fstashHome), buf, FormatTarGz))
+
+	status, _ = do(http.MethodPut, "/stashes/other-stash/archive", "secret", buf.Bytes())
+	require.Equal(http.StatusBadRequest, status)
+	status, body = do(http.MethodPut, "/stashes/sample-stash/archive", "secret", buf.Bytes())
+	require.Equal(http.StatusCreated, status, string(body))
+	m = &Manifest{}
+	require.NoError(json.Unmarshal(body, m))
+	require.Len(m.Versions, 2)
+	require.Equal("2", m.Version)
+
+	content, err := ioutil.ReadFile(filepath.Join(stashDir(homeDir3, "sample-stash"), "file1.txt"))
+	require.NoError(err)
+	require.Equal("changed", string(content))
+
+	// symlinks out of the stash, and files written through them, are refused
+	for _, hostile := range []map[string]string{
+		{"passwd": "/etc/passwd"},
+		{"up": "../../../../../../outside"},
+		{"dir1": "../../../../../..", "dir1/evil.txt": ""},
+	} {
+		buf := new(bytes.Buffer)
+		aw, err := newArchiveWriter(buf, FormatTarGz)
+		require.NoError(err)
+		for name, entry := range entries {
+			if entry.mode&os.ModeSymlink != 0 {
+				require.NoError(aw.writeSymlink(name, entry.link))
+			} else if !strings.HasPrefix(name, "stashes/sample-stash/content/dir1/") {
+				require.NoError(aw.writeFile(name, entry.mode, entry.content))
+			}
+		}
+		for name, target := range hostile {
+			name = "stashes/sample-stash/content/" + name
+			if target == "" {
+				require.NoError(aw.writeFile(name, 0644, []byte("evil")))
+			} else {
+				require.NoError(aw.writeSymlink(name, target))
+			}
+		}
+		require.NoError(aw.Close())
+
+		status, body = do(http.MethodPut, "/stashes/sample-stash/archive?on-conflict=merge", "secret", buf.Bytes())
+		require.Equal(http.StatusBadRequest, status, string(body))
+		m, err := readManifest(newDirStore(homeDir3), "sample-stash")
+		require.NoError(err)
+		require.Equal("2", m.Version)
+	}
+}
+
+func Test_remotes(t *testing.T) {
+	require := require.New(t)
+	fstashHome := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(fstashHome))
+	}()
+
+	remotes, err := readRemotes(fstashHome)
+	require.NoError(err)
+	require.Empty(remotes)
+
+	require.NoError(addRemote(fstashHome, "team", "http://localhost:8080/", "secret"))
+	require.NoError(addRemote(fstashHome, "backup", "https://example.com", ""))
+	require.Equal(ErrRemoteExists, addRemote(fstashHome, "team", "http://localhost:8081", ""))
+	require.Equal(ErrInvalidRemote, addRemote(fstashHome, "other", "ftp://example.com", ""))
+	require.Equal(ErrInvalidRemote, addRemote(fstashHome, "a/b", "http://example.com", ""))
+
+	client, err := New(fstashHome)
+	require.NoError(err)
+	remotes, err = client.Remotes(context.Background())
+	require.NoError(err)
+	require.Equal([]Remote{
+		{Name: "backup", URL: "https://example.com"},
+		{Name: "team", URL: "http://localhost:8080", Token: "secret"},
+	}, remotes)
+
+	info, err := os.Stat(filepath.Join(fstashHome, remotesFile))
+	require.NoError(err)
+	if runtime.GOOS != "windows" {
+		require.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+
+	require.NoError(removeRemote(fstashHome, "backup"))
+	require.Equal(ErrRemoteNotExist, removeRemote(fstashHome, "backup"))
+	remotes, err = readRemotes(fstashHome)
+	require.NoError(err)
+	require.Len(remotes, 1)
+
+	remoteName, stashName, version, ok := parseRemoteRef("team/Go-App@2")
+	require.True(ok)
+	require.Equal("team", remoteName)
+	require.Equal("go-app", stashName)
+	require.Equal("2", version)
+	_, _, _, ok = parseRemoteRef("go-app")
+	require.False(ok)
+}
+
+func Test_push_pull(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+	homeDir5 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir5))
+	}()
+
+	serverHome, localHome, otherHome, cacheHome := homeDir2, homeDir3, homeDir4, homeDir5
+	blobsSent, blobsFetched, archivesFetched := 0, 0, 0
+	handler := newServer(newDirStore(serverHome), "secret")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/archive") && r.Method == http.MethodGet {
+			archivesFetched++
+		}
+		if strings.HasPrefix(r.URL.Path, "/blobs/") && r.URL.Path != "/blobs/missing" {
+			switch r.Method {
+			case http.MethodPut:
+				blobsSent++
+			case http.MethodGet:
+				blobsFetched++
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	r := &Remote{Name: "team", URL: ts.URL, Token: "secret"}
+
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(localHome)))
+
+	m, err := pushStash(context.Background(), "sample-stash", newDirStore(localHome), r)
+	require.NoError(err)
+	require.Equal("1", m.Version)
+	require.Equal(2, blobsSent) // the files have only two distinct contents
+
+	// a second version only sends the changed file
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "file1.txt"), []byte("changed"), 0644))
+	_, err = updateStash("sample-stash", newDirStore(localHome), "")
+	require.NoError(err)
+	blobsSent = 0
+	m, err = pushStash(context.Background(), "sample-stash", newDirStore(localHome), r)
+	require.NoError(err)
+	require.Equal("2", m.Version)
+	require.Len(m.Versions, 2)
+	require.Equal(1, blobsSent)
+
+	require.NoError(pullStash(context.Background(), "sample-stash", "", newDirStore(otherHome), r))
+	require.Equal(3, blobsFetched)
+	require.Equal(0, archivesFetched) // the content is rebuilt from the blobs
+	pulled, _, err := openStash(newDirStore(otherHome), "sample-stash")
+	require.NoError(err)
+	dir := stashDir(otherHome, "sample-stash")
+	require.Equal("2", pulled.Version)
+	require.Len(pulled.Versions, 2)
+	require.Equal(ts.URL+"/stashes/sample-stash", pulled.Origin)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "file1.txt"))
+	require.NoError(err)
+	require.Equal("changed", string(content))
+
+	// nothing is fetched again, and an older version can be made current
+	blobsFetched = 0
+	require.NoError(pullStash(context.Background(), "sample-stash", "1", newDirStore(otherHome), r))
+	require.Equal(0, blobsFetched)
+	pulled, _, err = openStash(newDirStore(otherHome), "sample-stash")
+	require.NoError(err)
+	require.Equal("1", pulled.Version)
+	content, err = ioutil.ReadFile(filepath.Join(dir, "file1.txt"))
+	require.NoError(err)
+	require.Equal(staticContent, string(content))
+
+	require.Equal(ErrVersionNotExist, pullStash(context.Background(), "sample-stash", "9", newDirStore(otherHome), r))
+	require.True(errors.Is(pullStash(context.Background(), "missing", "", newDirStore(otherHome), r), ErrStashNotExist))
+	_, err = pushStash(context.Background(), "sample-stash", newDirStore(localHome), &Remote{Name: "team", URL: ts.URL, Token: "wrong"})
+	require.Error(err)
+
+	t.Run("expand from remote", func(t *testing.T) {
+		require.NoError(fetchStash(context.Background(), "sample-stash", "", newDirStore(cacheHome), r))
+		cached, _, err := openStash(newDirStore(cacheHome), "sample-stash")
+		require.NoError(err)
+		require.Equal("2", cached.Version)
+
+		blobsFetched = 0
+		require.NoError(fetchStash(context.Background(), "sample-stash", "", newDirStore(cacheHome), r))
+		require.Equal(0, blobsFetched)
+
+		require.NoError(fetchStash(context.Background(), "sample-stash", "1", newDirStore(cacheHome), r))
+		cached, _, err = openStash(newDirStore(cacheHome), "sample-stash")
+		require.NoError(err)
+		require.Equal("1", cached.Version)
+
+		// the cache is used when the remote can not be reached
+		offline := &Remote{Name: "team", URL: "http://127.0.0.1:1", Token: "secret"}
+		require.NoError(fetchStash(context.Background(), "sample-stash", "1", newDirStore(cacheHome), offline))
+		require.Error(fetchStash(context.Background(), "other-stash", "", newDirStore(cacheHome), offline))
+
+		dst := filepath.Join(homeDir1, "expanded")
+		data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+		require.NoError(expandStashWith("sample-stash", newDirStore(cacheHome), dst, expandOptions{data: data}))
+		content, err := ioutil.ReadFile(filepath.Join(dst, "file1.txt"))
+		require.NoError(err)
+		require.Equal(staticContent, string(content))
+	})
+
+	t.Run("upgrade from remote", func(t *testing.T) {
+		ctx := context.Background()
+		client, err := New(filepath.Join(homeDir1, "client-home"), WithCacheDir(filepath.Join(homeDir1, "client-cache")))
+		require.NoError(err)
+		require.NoError(client.AddRemote(ctx, "team", ts.URL, "secret"))
+
+		dst := filepath.Join(homeDir1, "from-remote")
+		data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+		require.NoError(client.Expand(ctx, "team/sample-stash@1", dst, ExpandOptions{Data: data, Lock: true}))
+		l, err := readLockFile(dst)
+		require.NoError(err)
+		require.Equal("team", l.Remote)
+		require.Equal("1", l.Version)
+
+		// a local stash of the same name is not the one upgraded from
+		unrelated := filepath.Join(homeDir1, "unrelated")
+		require.NoError(os.MkdirAll(unrelated, 0777))
+		require.NoError(ioutil.WriteFile(filepath.Join(unrelated, "unrelated.txt"), []byte("unrelated"), 0644))
+		require.NoError(client.Create(ctx, "sample-stash", []string{unrelated}, CreateOptions{}))
+
+		_, err = client.Upgrade(ctx, dst, UpgradeOptions{})
+		require.NoError(err)
+		content, err := ioutil.ReadFile(filepath.Join(dst, "file1.txt"))
+		require.NoError(err)
+		require.Equal("changed", string(content))
+		_, err = os.Stat(filepath.Join(dst, "unrelated.txt"))
+		require.True(os.IsNotExist(err))
+		l, err = readLockFile(dst)
+		require.NoError(err)
+		require.Equal("team", l.Remote)
+		require.Equal("2", l.Version)
+
+		_, err = client.Capture(ctx, "", dst, CaptureOptions{})
+		require.True(errors.Is(err, ErrReadOnlyHome))
+	})
+}
+
+func Test_commitHome(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	fstashHome := homeDir3
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(fstashHome)))
+	require.NoError(commitHome(context.Background(), fstashHome, newDirStore(fstashHome), "create sample-stash", "sample-stash"))
+	require.False(isGitRepo(fstashHome))
+
+	_, err := runGit(context.Background(), fstashHome, "init", "--quiet")
+	require.NoError(err)
+	require.NoError(commitHome(context.Background(), fstashHome, newDirStore(fstashHome), "create sample-stash", "sample-stash"))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "file1.txt"), []byte("changed"), 0644))
+	_, err = updateStash("sample-stash", newDirStore(fstashHome), "")
+	require.NoError(err)
+	require.NoError(commitHome(context.Background(), fstashHome, newDirStore(fstashHome), "update sample-stash", "sample-stash"))
+	require.NoError(commitHome(context.Background(), fstashHome, newDirStore(fstashHome), "nothing changed"))
+
+	log, err := runGit(context.Background(), fstashHome, "log", "--format=%s")
+	require.NoError(err)
+	require.Equal("update sample-stash\ncreate sample-stash", log)
+	tags, err := runGit(context.Background(), fstashHome, "tag", "--list")
+	require.NoError(err)
+	require.Equal("sample-stash/1\nsample-stash/2", tags)
+
+	rel, err := filepath.Rel(fstashHome, stashDir(fstashHome, "sample-stash"))
+	require.NoError(err)
+	content, err := runGit(context.Background(), fstashHome, "show", "sample-stash/1:"+filepath.ToSlash(rel)+"/file1.txt")
+	require.NoError(err)
+	require.Equal(staticContent, content)
+
+	l, err := listStashes(newDirStore(fstashHome))
+	require.NoError(err)
+	require.Equal([]string{"sample-stash"}, l)
+}
+
+func Test_gitStash(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.NoError(createSampleTreeWithTemplates(filepath.Join(homeDir1, "skeleton")))
+	git := func(dir string, args ...string) {
+		_, err := runGit(context.Background(), dir, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		require.NoError(err)
+	}
+	git(homeDir1, "init", "--quiet")
+	git(homeDir1, "add", ".")
+	git(homeDir1, "commit", "--quiet", "-m", "skeleton")
+	git(homeDir1, "tag", "v1")
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "skeleton", "file1.txt"), []byte("changed"), 0644))
+	git(homeDir1, "commit", "--quiet", "-a", "-m", "changed")
+	require.NoError(os.MkdirAll(homeDir2, 0777))
+	bare := filepath.Join(homeDir2, "skeletons.git")
+	git(homeDir2, "clone", "--bare", "--quiet", homeDir1, bare)
+
+	cacheDir := homeDir4
+	data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+	expand := func(repo, ref string) string {
+		store, name, err := gitStash(context.Background(), repo, ref, "skeleton", cacheDir)
+		require.NoError(err)
+		dst := filepath.Join(homeDir2, randTemp())
+		require.NoError(expandStashWith(name, store, dst, expandOptions{data: data}))
+		content, err := ioutil.ReadFile(filepath.Join(dst, "file1.txt"))
+		require.NoError(err)
+		_, err = os.Stat(filepath.Join(dst, "dir1", "file4.txt"))
+		require.NoError(err)
+		return string(content)
+	}
+
+	require.Equal(staticContent, expand(bare, "v1"))
+	require.Equal("changed", expand(bare, ""))
+	require.Equal("changed", expand(homeDir1, "master"))
+
+	// a URL is mirrored, and the mirror is used when offline
+	url := "file://" + filepath.ToSlash(bare)
+	require.Equal(staticContent, expand(url, "v1"))
+	require.NoError(os.Rename(bare, bare+".offline"))
+	require.Equal("changed", expand(url, "HEAD"))
+
+	_, _, err := gitStash(context.Background(), homeDir1, "missing", "", cacheDir)
+	require.Error(err)
+
+	// refs are never taken for options of git
+	pwned := filepath.Join(homeDir2, "pwned")
+	_, _, err = gitStash(context.Background(), homeDir1, "--output="+pwned, "", cacheDir)
+	require.Equal(ErrInvalidGitRef, err)
+	_, err = os.Stat(pwned)
+	require.True(os.IsNotExist(err))
+}
+
+// fakeS3 is a stand-in for an S3-compatible server, keeping objects of one
+// bucket in memory and checking the signatures of the requests.
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	accessKey string
+	secretKey string
+	objects   map[string][]byte
+	modes     map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(f.t, err)
+	signed, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	require.NoError(f.t, err)
+	for k, v := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-") {
+			signed.Header[k] = v
+		}
+	}
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	require.NoError(f.t, err)
+	signS3Request(signed, body, "us-east-1", f.accessKey, f.secretKey, now)
+	if signed.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	prefix := "/" + f.bucket
+	if r.URL.Path == prefix && r.Method == http.MethodGet {
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		// two keys a page, to go through continuation tokens
+		start := 0
+		if token := r.URL.Query().Get("continuation-token"); token != "" {
+			start, _ = strconv.Atoi(token)
+		}
+		fmt.Fprint(w, "<ListBucketResult>")
+		end := start + 2
+		if end >= len(keys) {
+			end = len(keys)
+		} else {
+			fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+		}
+		for _, k := range keys[start:end] {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", k)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix+"/")
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+		f.modes[key] = r.Header.Get(s3ModeHeader)
+	case http.MethodGet, http.MethodHead:
+		content, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(s3ModeHeader, f.modes[key])
+		w.Write(content)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func Test_stores(t *testing.T) {
+	require := require.New(t)
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+
+	s3 := &fakeS3{t: t, bucket: "stashes", accessKey: "key", secretKey: "secret",
+		objects: make(map[string][]byte), modes: make(map[string]string)}
+	ts := httptest.NewServer(s3)
+	defer ts.Close()
+
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+	require.NoError(os.MkdirAll(homeDir4, 0777))
+	bolt, err := openBoltStore(filepath.Join(homeDir4, boltFile))
+	require.NoError(err)
+	defer bolt.Close()
+
+	stores := map[string]Store{
+		"dir":  newDirStore(homeDir3),
+		"mem":  newMemStore(),
+		"s3":   newS3Store(ts.URL, "stashes", "team/", "us-east-1", "key", "secret"),
+		"bolt": bolt,
+	}
+	blob := []byte("content of a version")
+	blobKey := "blobs/" + digestOf(blob)
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := store.Get(contentKey("sample-stash", "file1.txt"))
+			require.Equal(ErrKeyNotExist, err)
+			_, err = store.Stat(contentKey("sample-stash", "file1.txt"))
+			require.Equal(ErrKeyNotExist, err)
+
+			require.NoError(store.Put("stashes/sample-stash/manifest.json", []byte(`{"name":"sample-stash"}`), 0644))
+			require.NoError(store.Put(contentKey("sample-stash", "file1.txt"), []byte(staticContent), 0644))
+			require.NoError(store.Put(contentKey("sample-stash", "dir 1/build.sh"), []byte("#!/bin/sh\n"), 0755))
+			require.NoError(store.Put(blobKey, blob, 0644))
+			if runtime.GOOS != "windows" {
+				require.NoError(store.Put(contentKey("sample-stash", "link.txt"), []byte("file1.txt"), os.ModeSymlink|0777))
+				content, mode, err := store.Get(contentKey("sample-stash", "link.txt"))
+				require.NoError(err)
+				require.Equal("file1.txt", string(content))
+				require.True(mode&os.ModeSymlink != 0)
+				require.NoError(store.Delete(contentKey("sample-stash", "link.txt")))
+			}
+
+			content, mode, err := store.Get(contentKey("sample-stash", "dir 1/build.sh"))
+			require.NoError(err)
+			require.Equal("#!/bin/sh\n", string(content))
+			if runtime.GOOS != "windows" {
+				require.Equal(os.FileMode(0755), mode)
+			}
+			mode, err = store.Stat(contentKey("sample-stash", "file1.txt"))
+			require.NoError(err)
+			require.Equal(os.FileMode(0644), mode)
+
+			keys, err := store.List("")
+			require.NoError(err)
+			require.Equal([]string{
+				blobKey,
+				"stashes/sample-stash/content/dir 1/build.sh",
+				"stashes/sample-stash/content/file1.txt",
+				"stashes/sample-stash/manifest.json",
+			}, keys)
+			keys, err = store.List("stashes/")
+			require.NoError(err)
+			require.Len(keys, 3)
+
+			require.NoError(store.Delete(contentKey("sample-stash", "dir 1/build.sh")))
+			require.NoError(store.Delete(contentKey("sample-stash", "missing.txt")))
+			keys, err = store.List("stashes/sample-stash/content/")
+			require.NoError(err)
+			require.Equal([]string{"stashes/sample-stash/content/file1.txt"}, keys)
+
+			for _, key := range []string{blobKey, "stashes/sample-stash/manifest.json", contentKey("sample-stash", "file1.txt")} {
+				require.NoError(store.Delete(key))
+			}
+			keys, err = store.List("")
+			require.NoError(err)
+			require.Empty(keys)
+		})
+	}
+
+	require.True(errors.Is(stores["dir"].Put("stashes/../content/x", nil, 0644), ErrInvalidKey))
+	require.True(errors.Is(stores["dir"].Put("blobs/not-a-digest", nil, 0644), ErrInvalidKey))
+	require.True(errors.Is(stores["bolt"].Put("stashes/../content/x", nil, 0644), ErrInvalidKey))
+	_, err = os.Stat(stashDir(homeDir3, "sample-stash"))
+	require.True(os.IsNotExist(err))
+
+	s3.secretKey = "other"
+	require.Error(stores["s3"].Put(blobKey, blob, 0644))
+}
+
+func Test_storeStashes(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+
+	// the stashes live in the store only
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	store := newMemStore()
+	require.NoError(createStash("sample-stash", homeDir1, store))
+	names, err := listStashes(store)
+	require.NoError(err)
+	require.Equal([]string{"sample-stash"}, names)
+
+	dst := filepath.Join(homeDir2, "expanded")
+	require.NoError(expandStashWith("sample-stash", store, dst, expandOptions{lock: true}))
+	content, err := ioutil.ReadFile(filepath.Join(dst, "file1.txt"))
+	require.NoError(err)
+	require.Equal(staticContent, string(content))
+
+	require.NoError(os.Remove(filepath.Join(homeDir1, "dir1", "file3.txt")))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "file1.txt"), []byte("changed"), 0644))
+	changes, err := updateStash("sample-stash", store, "")
+	require.NoError(err)
+	require.Equal([]FileChange{{"dir1/file3.txt", "removed"}, {"file1.txt", "changed"}}, changes)
+	_, err = store.Stat(contentKey("sample-stash", "dir1/file3.txt"))
+	require.Equal(ErrKeyNotExist, err)
+
+	upgraded, err := upgradeDir(store, dst, upgradeOptions{})
+	require.NoError(err)
+	require.Len(upgraded, 2)
+
+	require.NoError(renameStash("sample-stash", "renamed", store))
+	require.NoError(copyStash("renamed", "copied", store))
+	names, err = listStashes(store)
+	require.NoError(err)
+	require.Equal([]string{"copied", "renamed"}, names)
+	m, _, err := openStash(store, "copied")
+	require.NoError(err)
+	require.Equal("2", m.Version)
+	require.NoError(deleteStash("renamed", store))
+	keys, err := store.List("stashes/renamed/")
+	require.NoError(err)
+	require.Empty(keys)
+	_, err = os.Stat(homeDir3)
+	require.True(os.IsNotExist(err))
+
+	// a failing batch leaves the directory layout as it was
+	dir := newDirStore(homeDir3)
+	buf := new(bytes.Buffer)
+	require.NoError(exportStashes(nil, store, buf, FormatTarGz))
+	archive := filepath.Join(homeDir2, "stashes.tar.gz")
+	require.NoError(ioutil.WriteFile(archive, buf.Bytes(), 0644))
+	_, err = importStashes(context.Background(), archive, dir, importOptions{})
+	require.NoError(err)
+	failed := errors.New("failed")
+	err = dir.Batch(func(tx Store) error {
+		require.NoError(writeContent(tx, "copied", map[string]*archiveEntry{"new.txt": {content: []byte("new")}}))
+		require.NoError(tx.Delete(manifestKey("copied")))
+		return failed
+	})
+	require.Equal(failed, err)
+	m, files, err := openStash(dir, "copied")
+	require.NoError(err)
+	require.Equal("2", m.Version)
+	require.Contains(files, "file1.txt")
+	require.NotContains(files, "new.txt")
+
+	// and a successful one replaces the files of the stash at once
+	require.NoError(dir.Batch(func(tx Store) error {
+		return writeContent(tx, "copied", map[string]*archiveEntry{"new.txt": {content: []byte("new")}})
+	}))
+	tree, err := readTree(stashDir(homeDir3, "copied"))
+	require.NoError(err)
+	require.Equal(map[string][]string{".": {"new.txt"}}, tree)
+	_, err = os.Stat(stashDir(homeDir3, "copied") + ".old")
+	require.True(os.IsNotExist(err))
+}
+
+func Test_copyStore(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(homeDir3)))
+	require.NoError(createStash("other-stash", filepath.Join(homeDir1, "dir1"), newDirStore(homeDir3)))
+
+	store := newMemStore()
+	n, err := copyStore(store, newDirStore(homeDir3))
+	require.NoError(err)
+	require.Equal(len(store.files), n)
+	keys, err := store.List("stashes/")
+	require.NoError(err)
+	require.Len(keys, 8)
+
+	// loaded into another home, the stashes work as they are
+	_, err = copyStore(newDirStore(homeDir4), store)
+	require.NoError(err)
+	l, err := listStashes(newDirStore(homeDir4))
+	require.NoError(err)
+	sort.Strings(l)
+	require.Equal([]string{"other-stash", "sample-stash"}, l)
+	m, _, err := openStash(newDirStore(homeDir4), "sample-stash")
+	require.NoError(err)
+	require.Equal("1", m.Version)
+
+	// copying again overwrites the keys, the other keys are left alone
+	require.NoError(deleteStash("other-stash", newDirStore(homeDir4)))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "file1.txt"), []byte("changed"), 0644))
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(homeDir4)))
+	_, err = copyStore(store, newDirStore(homeDir4))
+	require.NoError(err)
+	keys, err = store.List("stashes/other-stash/")
+	require.NoError(err)
+	require.NotEmpty(keys)
+	content, _, err := store.Get(contentKey("sample-stash", "file1.txt"))
+	require.NoError(err)
+	require.Equal("changed", string(content))
+	keys, err = store.List("blobs/")
+	require.NoError(err)
+	require.Len(keys, 3)
+
+	s3, err := openStore("s3://bucket/team", "", func(string) string { return "" })
+	require.NoError(err)
+	require.Equal("team/", s3.(*s3Store).prefix)
+	_, err = openStore("ftp://bucket", "", os.Getenv)
+	require.Equal(ErrUnknownStore, err)
+	s, err := openStore("", "", os.Getenv)
+	require.NoError(err)
+	require.Nil(s)
+}
+
+func Test_boltStore(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(createStash("sample-stash", homeDir1, newDirStore(homeDir3)))
+	for i := 0; i < 10; i++ {
+		content := []byte(fmt.Sprintf("version %d", i+2))
+		require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "file1.txt"), content, 0644))
+		_, err := updateStash("sample-stash", newDirStore(homeDir3), "")
+		require.NoError(err)
+	}
+
+	store, err := openStore("bolt", homeDir3, os.Getenv)
+	require.NoError(err)
+	bolt := store.(*boltStore)
+	defer bolt.Close()
+
+	// migrating copies everything, versions keep their order
+	_, err = copyStore(bolt, newDirStore(homeDir3))
+	require.NoError(err)
+	_, err = copyStore(newDirStore(homeDir4), bolt)
+	require.NoError(err)
+	m, _, err := openStash(newDirStore(homeDir4), "sample-stash")
+	require.NoError(err)
+	require.Len(m.Versions, 11)
+	require.Equal("11", m.Version)
+	for i, v := range m.Versions {
+		require.Equal(strconv.Itoa(i+1), v.Version)
+	}
+	v, err := renderVersion(newDirStore(homeDir4), m, m.findVersion("5"), map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`})
+	require.NoError(err)
+	require.Equal("version 5", string(v["file1.txt"]))
+
+	// a failing batch changes nothing
+	failed := errors.New("failed")
+	err = bolt.Batch(func(tx Store) error {
+		require.NoError(tx.Delete("stashes/sample-stash/manifest.json"))
+		require.NoError(tx.Put(contentKey("other-stash", "file.txt"), []byte("content"), 0644))
+		return failed
+	})
+	require.Equal(failed, err)
+	keys, err := bolt.List("stashes/")
+	require.NoError(err)
+	require.Len(keys, 5)
+	require.Equal("stashes/sample-stash/manifest.json", keys[4])
+
+	// deleting a stash takes its nested buckets with it
+	require.NoError(deleteStash("sample-stash", bolt))
+	keys, err = bolt.List("stashes/")
+	require.NoError(err)
+	require.Empty(keys)
+}
+
+func Test_Client(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(os.MkdirAll(homeDir4, 0777))
+	ctx := context.Background()
+
+	t.Run("home", func(t *testing.T) {
+		client, err := New(homeDir3)
+		require.NoError(err)
+
+		opts := CreateOptions{Templates: []string{"file2.txt"}}
+		require.NoError(client.Create(ctx, "sample-stash", []string{homeDir1}, opts))
+		err = client.Copy(ctx, "sample-stash", "sample-stash")
+		require.True(errors.Is(err, ErrStashExists))
+		var e *Error
+		require.True(errors.As(err, &e))
+		require.Equal("copy", e.Op)
+		require.Equal("sample-stash", e.Stash)
+		require.Equal("copy sample-stash: stash already exists", err.Error())
+
+		names, err := client.List(ctx)
+		require.NoError(err)
+		require.Equal([]string{"sample-stash"}, names)
+		m, err := client.Manifest(ctx, "sample-stash")
+		require.NoError(err)
+		require.Equal("1", m.Version)
+
+		data := map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}
+		dst := filepath.Join(homeDir2, "expanded")
+		require.NoError(client.Expand(ctx, "sample-stash", dst, ExpandOptions{Data: data, Lock: true}))
+		content, err := ioutil.ReadFile(filepath.Join(dst, "file2.txt"))
+		require.NoError(err)
+		require.Equal("Author of fstash is dc0d.", string(content))
+		changes, err := client.Status(ctx, dst)
+		require.NoError(err)
+		require.Empty(changes)
+
+		_, err = client.Manifest(ctx, "missing")
+		require.True(errors.Is(err, ErrStashNotExist))
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		err = client.Delete(canceled, "sample-stash")
+		require.True(errors.Is(err, context.Canceled))
+		require.NoError(client.Delete(ctx, "sample-stash"))
+		names, err = client.List(ctx)
+		require.NoError(err)
+		require.Empty(names)
+	})
+
+	t.Run("store", func(t *testing.T) {
+		store := newMemStore()
+		client, err := New(homeDir3)
+		require.NoError(err)
+
+		require.NoError(client.Create(ctx, "stored-stash", []string{homeDir1}, CreateOptions{}))
+		n, err := client.Migrate(ctx, store)
+		require.NoError(err)
+		require.Equal(len(store.files), n)
+		_, err = store.Stat("stashes/stored-stash/manifest.json")
+		require.NoError(err)
+
+		// stores are copied explicitly, commands work on fstash home only
+		require.NoError(client.Delete(ctx, "stored-stash"))
+		_, err = store.Stat("stashes/stored-stash/manifest.json")
+		require.NoError(err)
+
+		other, err := New(homeDir2)
+		require.NoError(err)
+		n, err = other.MigrateFrom(ctx, store)
+		require.NoError(err)
+		require.Equal(len(store.files), n)
+		names, err := other.List(ctx)
+		require.NoError(err)
+		require.Contains(names, "stored-stash")
+
+		// with a bolt store, commands work on the database file
+		bolt, err := openBoltStore(filepath.Join(homeDir4, "stashes.db"))
+		require.NoError(err)
+		defer bolt.Close()
+		boltClient, err := New(homeDir4, WithStore(bolt))
+		require.NoError(err)
+		require.NoError(boltClient.Create(ctx, "bolt-stash", []string{homeDir1}, CreateOptions{}))
+		names, err = boltClient.List(ctx)
+		require.NoError(err)
+		require.Equal([]string{"bolt-stash"}, names)
+		_, err = os.Stat(stashDir(homeDir4, "bolt-stash"))
+		require.True(os.IsNotExist(err))
+		dst := filepath.Join(homeDir4, "expanded")
+		require.NoError(boltClient.Expand(ctx, "bolt-stash", dst, ExpandOptions{}))
+		_, err = os.Stat(filepath.Join(dst, "file1.txt"))
+		require.NoError(err)
+		require.NoError(boltClient.Delete(ctx, "bolt-stash"))
+		keys, err := bolt.List("stashes/")
+		require.NoError(err)
+		require.Empty(keys)
+	})
+}
+
+func Test_config(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "debug.log"), []byte("log"), 0644))
+	require.NoError(os.MkdirAll(homeDir2, 0777))
+
+	env := map[string]string{"HOME": homeDir2}
+	getenv := func(k string) string { return env[k] }
+
+	fp, err := DefaultConfigPath(getenv)
+	require.NoError(err)
+	require.Equal(filepath.Join(homeDir2, ".config", "fstash", "config.yaml"), fp)
+	env["XDG_CONFIG_HOME"] = filepath.Join(homeDir2, "config")
+	fp, err = DefaultConfigPath(getenv)
+	require.NoError(err)
+	require.Equal(filepath.Join(homeDir2, "config", "fstash", "config.yaml"), fp)
+
+	cfg, err := LoadConfig(fp)
+	require.NoError(err)
+	require.Equal(&Config{}, cfg)
+	require.NoError(os.MkdirAll(filepath.Dir(fp), 0777))
+	require.NoError(ioutil.WriteFile(fp, []byte("on_conflict: sometimes\n"), 0644))
+	_, err = LoadConfig(fp)
+	require.True(errors.Is(err, ErrUnknownConflict))
+	require.NoError(ioutil.WriteFile(fp, []byte("unknown: true\n"), 0644))
+	_, err = LoadConfig(fp)
+	require.Error(err)
+	require.NoError(ioutil.WriteFile(fp, []byte(`home: ~/stashes
+ignore: ["*.log"]
+on_conflict: rename
+data:
+  file2:
+    AppName: fstash
+    Author: dc0d
+remotes:
+  - name: team
+    url: http://localhost:8080
+    token: secret
+`), 0644))
+	cfg, err = LoadConfig(fp)
+	require.NoError(err)
+	require.Equal("rename", cfg.OnConflict)
+	require.Equal([]Remote{{Name: "team", URL: "http://localhost:8080", Token: "secret"}}, cfg.Remotes)
+
+	t.Run("home", func(t *testing.T) {
+		home, err := DefaultHome(nil, getenv)
+		require.NoError(err)
+		require.Equal(filepath.Join(homeDir2, ".fstash"), home)
+		home, err = DefaultHome(cfg, getenv)
+		require.NoError(err)
+		require.Equal(filepath.Join(homeDir2, "stashes"), home)
+
+		env["XDG_DATA_HOME"] = filepath.Join(homeDir2, "data")
+		home, err = DefaultHome(nil, getenv)
+		require.NoError(err)
+		require.Equal(filepath.Join(homeDir2, "data", "fstash"), home)
+		// an existing ~/.fstash is kept
+		require.NoError(os.MkdirAll(filepath.Join(homeDir2, ".fstash"), 0777))
+		home, err = DefaultHome(nil, getenv)
+		require.NoError(err)
+		require.Equal(filepath.Join(homeDir2, ".fstash"), home)
+
+		env["FSTASH_HOME"] = homeDir3
+		home, err = DefaultHome(cfg, getenv)
+		require.NoError(err)
+		require.Equal(homeDir3, home)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		ctx := context.Background()
+		client, err := New(homeDir3, WithConfig(cfg))
+		require.NoError(err)
+		require.NoError(client.Create(ctx, "sample-stash", []string{homeDir1}, CreateOptions{Templates: []string{"file2.txt"}}))
+		m, err := client.Manifest(ctx, "sample-stash")
+		require.NoError(err)
+		require.Equal([]string{"*.log"}, m.Ignore)
+		require.NotContains(m.Versions[0].Files, "debug.log")
+
+		// update keeps ignoring them
+		require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "debug.log"), []byte("more log"), 0644))
+		changes, err := client.Update(ctx, "sample-stash", "")
+		require.NoError(err)
+		require.Empty(changes)
+
+		dst := filepath.Join(homeDir2, "expanded")
+		require.NoError(client.Expand(ctx, "sample-stash", dst, ExpandOptions{}))
+		content, err := ioutil.ReadFile(filepath.Join(dst, "file2.txt"))
+		require.NoError(err)
+		require.Equal("Author of fstash is dc0d.", string(content))
+		data := map[string]string{"file2": `{"AppName":"app","Author":"me"}`}
+		require.NoError(client.Expand(ctx, "sample-stash", dst, ExpandOptions{Data: data}))
+		content, err = ioutil.ReadFile(filepath.Join(dst, "file2.txt"))
+		require.NoError(err)
+		require.Equal("Author of app is me.", string(content))
+
+		names, err := client.Import(ctx, homeDir1, ImportOptions{Name: "sample-stash"})
+		require.NoError(err)
+		require.Equal([]string{"sample-stash-2"}, names)
+
+		require.NoError(client.AddRemote(ctx, "other", "http://localhost:9090", ""))
+		remotes, err := client.Remotes(ctx)
+		require.NoError(err)
+		require.Len(remotes, 2)
+		require.Equal("other", remotes[0].Name)
+		require.Equal("team", remotes[1].Name)
+	})
+}
+
+func Test_meta(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	ctx := context.Background()
+
+	team, err := New(homeDir3)
+	require.NoError(err)
+	require.NoError(team.Create(ctx, "service", []string{homeDir1 + ":api"}, CreateOptions{
+		Meta: Meta{Description: "HTTP service skeleton", Tags: []string{"go"}},
+	}))
+
+	client, err := New(homeDir2, WithSearchPath(SearchHome{Name: "team", Path: homeDir3}))
+	require.NoError(err)
+	err = client.Create(ctx, "goapp", []string{homeDir1}, CreateOptions{
+		Meta: Meta{
+			Description: " Go application ",
+			Tags:        []string{"Go", "cli", "go"},
+			Author:      "Kaveh",
+			Homepage:    "https://example.com/goapp",
+		},
+	})
+	require.NoError(err)
+	m, err := client.Manifest(ctx, "goapp")
+	require.NoError(err)
+	require.Equal(Meta{
+		Description: "Go application",
+		Tags:        []string{"cli", "go"},
+		Author:      "Kaveh",
+		Homepage:    "https://example.com/goapp",
+	}, m.Meta)
+
+	// creating it again keeps the fields not given
+	require.NoError(client.Create(ctx, "goapp", []string{homeDir1}, CreateOptions{Meta: Meta{Author: "dc0d"}}))
+	m, err = client.Manifest(ctx, "goapp")
+	require.NoError(err)
+	require.Equal("Go application", m.Description)
+	require.Equal("dc0d", m.Author)
+
+	err = client.Create(ctx, "other", []string{homeDir1}, CreateOptions{Meta: Meta{Tags: []string{"no spaces"}}})
+	require.True(errors.Is(err, ErrInvalidTag))
+	_, err = client.Manifest(ctx, "other")
+	require.True(errors.Is(err, ErrStashNotExist))
+	err = client.SetMeta(ctx, "goapp", Meta{Homepage: "ftp://example.com"})
+	require.True(errors.Is(err, ErrInvalidHomepage))
+	err = client.SetMeta(ctx, "team:service", Meta{Description: "mine"})
+	require.True(errors.Is(err, ErrReadOnlyHome))
+
+	require.NoError(client.SetMeta(ctx, "goapp", Meta{Description: "Command line tool", Tags: []string{"tool"}}))
+	m, err = client.Manifest(ctx, "goapp")
+	require.NoError(err)
+	require.Equal(Meta{Description: "Command line tool", Tags: []string{"tool"}}, m.Meta)
+
+	results, err := client.Search(ctx, "GO")
+	require.NoError(err)
+	require.Equal([]SearchResult{
+		{StashEntry: StashEntry{Name: "goapp", Home: LocalHome}, Description: "Command line tool", Fields: []string{"name"}},
+		{StashEntry: StashEntry{Name: "service", Home: "team"}, Description: "HTTP service skeleton", Fields: []string{"tags"}},
+	}, results)
+	results, err = client.Search(ctx, "file4")
+	require.NoError(err)
+	require.Len(results, 2)
+	require.Equal([]string{"dir1/file4.txt"}, results[0].Files)
+	require.Equal([]string{"api/dir1/file4.txt"}, results[1].Files)
+	results, err = client.Search(ctx, "skeleton")
+	require.NoError(err)
+	require.Len(results, 1)
+	require.Equal([]string{"description"}, results[0].Fields)
+	results, err = client.Search(ctx, "nothing like it")
+	require.NoError(err)
+	require.Empty(results)
+
+	// copies keep the metadata
+	require.NoError(client.Copy(ctx, "team:service", "my-service"))
+	m, err = client.Manifest(ctx, "my-service")
+	require.NoError(err)
+	require.Equal("HTTP service skeleton", m.Description)
+}
+
+func Test_data(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	require.NoError(os.MkdirAll(homeDir2, 0777))
+	ctx := context.Background()
+
+	files := map[string]string{
+		"data.yaml": "Author: yaml\nvariables:\n  License: MIT\n  Year: 2020\n",
+		"data.toml": "[variables]\nLicense = \"Apache\"\n",
+		".env":      "# defaults\nYear=2027\nexport Team='core'\n",
+		"vars.json": `{"Module": "github.com/kaveh/app"}`,
+		"data.ini":  "Author=ini\n",
+	}
+	for name, content := range files {
+		require.NoError(ioutil.WriteFile(filepath.Join(homeDir2, name), []byte(content), 0644))
+	}
+	fp := func(name string) string { return filepath.Join(homeDir2, name) }
+
+	environ := []string{"FSTASH_VAR_Author=env", "FSTASH_VAR_Year=2026", "HOME=/root", "FSTASH_VAR_=empty"}
+	data, err := LoadData(environ, nil, nil)
+	require.NoError(err)
+	require.Equal(map[string]string{AllTemplates: `{"Author":"env","Year":"2026"}`}, data)
+
+	data, err = LoadData(environ,
+		[]string{fp("data.yaml"), fp("data.toml"), fp(".env")},
+		map[string]string{"variables": "@" + fp("vars.json"), "README": `{"Title":"app"}`})
+	require.NoError(err)
+	require.Equal(map[string]string{
+		AllTemplates: `{"Author":"yaml","Team":"core","Year":"2027"}`,
+		// the data files are one layer, so their data for all templates goes
+		// under the data of the keys, and the entries' over it
+		"variables": `{"Author":"yaml","License":"Apache","Module":"github.com/kaveh/app","Team":"core","Year":2020}`,
+		"README":    `{"Title":"app"}`,
+	}, data)
+
+	_, err = LoadData(nil, []string{fp("data.ini")}, nil)
+	require.True(errors.Is(err, ErrDataFileFormat))
+	_, err = LoadData(nil, nil, map[string]string{"variables": "@" + fp("missing.json")})
+	require.True(os.IsNotExist(err))
+
+	cfg := &Config{data: map[string]string{"file2": `{"AppName":"fstash","Author":"dc0d"}`}}
+	client, err := New(filepath.Join(homeDir2, "home"), WithConfig(cfg))
+	require.NoError(err)
+	require.NoError(client.Create(ctx, "sample-stash", []string{homeDir1}, CreateOptions{Templates: sampleTemplates}))
+	expand := func(data map[string]string) (string, string) {
+		dst := filepath.Join(homeDir2, randTemp())
+		require.NoError(client.Expand(ctx, "sample-stash", dst, ExpandOptions{Data: data}))
+		file2, err := ioutil.ReadFile(filepath.Join(dst, "file2.txt"))
+		require.NoError(err)
+		file4, err := ioutil.ReadFile(filepath.Join(dst, "dir1", "file4.txt"))
+		require.NoError(err)
+		return string(file2), string(file4)
+	}
+
+	// given data for all templates wins over the data of a key in the config
+	file2, file4 := expand(map[string]string{AllTemplates: `{"AppName":"all","Author":"all"}`})
+	require.Equal("Author of all is all.", file2)
+	require.Equal("Author of all is all.", file4)
+	// given data replaces the config field by field
+	file2, _ = expand(map[string]string{"file2": `{"Author":"me"}`, "file4": `{"AppName":"Web","Author":"me"}`})
+	require.Equal("Author of fstash is me.", file2)
+	// and the data of a key wins over data for all templates of its layer
+	file2, file4 = expand(map[string]string{AllTemplates: `{"AppName":"all","Author":"all"}`, "file4": `{"Author":"me"}`})
+	require.Equal("Author of all is all.", file2)
+	require.Equal("Author of all is me.", file4)
+	cfg.data = map[string]string{AllTemplates: `{"Author":"config"}`, "file2": `{"AppName":"fstash"}`}
+	file2, file4 = expand(map[string]string{"file4": `{"AppName":"Web"}`})
+	require.Equal("Author of fstash is config.", file2)
+	require.Equal("Author of Web is config.", file4)
+}
+
+func Test_stashFile(t *testing.T) {
+	require := require.New(t)
+	homeDir := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir))
+	}()
+	srcDir := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(srcDir))
+	}()
+	dstDir := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(dstDir))
+	}()
+	ctx := context.Background()
+
+	sample := map[string]string{
+		"main.go":                        "package {{.Package}}\n\n// {{.Name.First}} wrote it\n",
+		"README.md.tmpl":                 "# {{if .Title}}{{.Title}}{{else}}untitled{{end}}\n{{range .Items}}- {{.}}\n{{end}}",
+		"ci/workflow.yml":                "token: ${{ secrets.TOKEN }}\n",
+		"docs/notes.txt":                 "no actions here\n",
+		"debug.log":                      "noise\n",
+		filepath.Join("ci", "deploy.sh"): "echo deploy\n",
+	}
+	for name, content := range sample {
+		fp := filepath.Join(srcDir, name)
+		require.NoError(os.MkdirAll(filepath.Dir(fp), 0777))
+		require.NoError(ioutil.WriteFile(fp, []byte(content), 0666))
+	}
+
+	var confirmed []*Hooks
+	confirm := func(m *Manifest, hooks *Hooks) bool {
+		confirmed = append(confirmed, hooks)
+		return true
+	}
+	client, err := New(homeDir, WithConfig(&Config{Ignore: []string{"*.log"}}), WithHookConfirm(confirm))
+	require.NoError(err)
+	fp, err := client.Init(ctx, srcDir, InitOptions{})
+	require.NoError(err)
+	require.Equal(filepath.Join(srcDir, StashFileYAML), fp)
+	sf, err := readStashFile(srcDir)
+	require.NoError(err)
+	require.Equal([]string{"README.md.tmpl", "ci/deploy.sh", "ci/workflow.yml", "docs/notes.txt", "main.go"}, sf.Files)
+	require.Equal([]string{"main.go"}, sf.Templates)
+	require.NotNil(sf.Hooks)
+	require.True(sf.Hooks.empty())
+	require.Equal([]string{"*.log"}, sf.Ignore)
+	data, err := sf.data()
+	require.NoError(err)
+	require.Equal(map[string]string{
+		"main":   `{"Name":{"First":""},"Package":""}`,
+		"README": `{"Items":[],"Title":""}`,
+	}, data)
+
+	_, err = client.Init(ctx, srcDir, InitOptions{Format: "json"})
+	require.True(errors.Is(err, ErrStashFileExists))
+	_, err = client.Init(ctx, srcDir, InitOptions{Format: "toml", Force: true})
+	require.True(errors.Is(err, ErrStashFileFormat))
+	fp, err = client.Init(ctx, srcDir, InitOptions{Format: "json", Force: true})
+	require.NoError(err)
+	require.Equal(filepath.Join(srcDir, StashFileJSON), fp)
+	_, err = os.Stat(filepath.Join(srcDir, StashFileYAML))
+	require.True(os.IsNotExist(err))
+
+	// listed files have to exist
+	sf.Files = []string{"README.md.tmpl", "missing.txt"}
+	require.NoError(os.Remove(fp))
+	require.NoError(writeStashFile(srcDir, StashFileYAML, sf))
+	err = client.Create(ctx, "described", []string{srcDir}, CreateOptions{})
+	require.True(errors.Is(err, ErrListedFileNotExist))
+
+	// the edited stash file lists the files, gives defaults and adds a hook
+	sf.Files = []string{"README.md.tmpl", "ci/workflow.yml", "main.go"}
+	sf.Variables["main"]["Package"] = "app"
+	sf.Hooks = &Hooks{PostExpand: []string{"echo done > done.txt"}}
+	require.NoError(writeStashFile(srcDir, StashFileYAML, sf))
+
+	require.NoError(client.Create(ctx, "described", []string{srcDir}, CreateOptions{}))
+	m, err := client.Manifest(ctx, "described")
+	require.NoError(err)
+	require.Equal([]string{"main.go"}, m.Templates)
+	require.Nil(m.Hooks)
+	require.Equal(&Hooks{PostExpand: []string{"echo done > done.txt"}}, m.FileHooks)
+	require.Len(m.Versions[0].Files, 3)
+
+	err = client.Expand(ctx, "described", dstDir, ExpandOptions{
+		Data: map[string]string{"main": `{"Name": {"First": "Kaveh"}}`},
+	})
+	require.NoError(err)
+	content, err := ioutil.ReadFile(filepath.Join(dstDir, "main.go"))
+	require.NoError(err)
+	require.Equal("package app\n\n// Kaveh wrote it\n", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(dstDir, "README.md"))
+	require.NoError(err)
+	require.Equal("# untitled\n", string(content))
+	for _, name := range []string{StashFileYAML, "debug.log", "ci/deploy.sh", "done.txt"} {
+		_, err = os.Stat(filepath.Join(dstDir, name))
+		require.Equal(name == "done.txt", err == nil, name)
+	}
+	// hooks of stash files are confirmed, like the ones of imported stashes
+	require.Equal([]*Hooks{{PostExpand: []string{"echo done > done.txt"}}}, confirmed)
+	other, err := New(homeDir)
+	require.NoError(err)
+	err = other.Expand(ctx, "described", filepath.Join(dstDir, "unconfirmed"), ExpandOptions{})
+	require.True(errors.Is(err, ErrHooksNotConfirmed))
+
+	// the environment wins over the defaults of the stash file
+	data, err = LoadData([]string{"FSTASH_VAR_Package=env"}, nil, nil)
+	require.NoError(err)
+	envDir := filepath.Join(dstDir, "env")
+	require.NoError(client.Expand(ctx, "described", envDir, ExpandOptions{Data: data, NoHooks: true}))
+	content, err = ioutil.ReadFile(filepath.Join(envDir, "main.go"))
+	require.NoError(err)
+	require.Equal("package env\n\n//  wrote it\n", string(content))
+
+	// update follows the stash file
+	sf.Files = append(sf.Files, "docs/notes.txt")
+	sf.Variables["main"]["Package"] = "tool"
+	require.NoError(writeStashFile(srcDir, StashFileYAML, sf))
+	changes, err := client.Update(ctx, "described", "")
+	require.NoError(err)
+	require.Equal([]FileChange{{"docs/notes.txt", "added"}}, changes)
+	m, err = client.Manifest(ctx, "described")
+	require.NoError(err)
+	require.Equal(`{"Name":{"First":""},"Package":"tool"}`, m.Data["main"])
+
+	// and so do changes of its templates and hooks alone
+	sf.Templates = append(sf.Templates, "ci/*.yml")
+	sf.Hooks = &Hooks{PostExpand: []string{"echo changed > done.txt"}}
+	require.NoError(writeStashFile(srcDir, StashFileYAML, sf))
+	changes, err = client.Update(ctx, "described", "")
+	require.NoError(err)
+	require.Empty(changes)
+	m, err = client.Manifest(ctx, "described")
+	require.NoError(err)
+	require.Equal("3", m.Version)
+	require.Equal([]string{"ci/workflow.yml", "main.go"}, m.Templates)
+	require.Equal(sf.Hooks, m.FileHooks)
+	changes, err = client.Update(ctx, "described", "")
+	require.NoError(err)
+	require.Empty(changes)
+	m, err = client.Manifest(ctx, "described")
+	require.NoError(err)
+	require.Equal("3", m.Version)
+}
+
+func Test_projectHome(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	repo := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(repo))
+	}()
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	ctx := context.Background()
+
+	nested := filepath.Join(repo, "services", "api")
+	require.NoError(os.MkdirAll(nested, 0777))
+	require.Equal("", FindProjectHome(nested, homeDir2))
+	require.NoError(os.MkdirAll(filepath.Join(repo, ".git"), 0777))
+	require.Equal("", FindProjectHome(nested, homeDir2))
+
+	project := filepath.Join(repo, ".fstash")
+	require.NoError(os.MkdirAll(project, 0777))
+	require.Equal(project, FindProjectHome(nested, homeDir2))
+	require.Equal(project, FindProjectHome(repo, homeDir2))
+	// fstash home itself is not a project home
+	require.Equal("", FindProjectHome(nested, project))
+
+	owner, err := New(project)
+	require.NoError(err)
+	require.NoError(owner.Create(ctx, "component", []string{homeDir1 + ":team"}, CreateOptions{}))
+
+	client, err := New(homeDir2, WithProjectHome(FindProjectHome(nested, homeDir2)))
+	require.NoError(err)
+	require.NoError(client.Create(ctx, "component", []string{homeDir1 + ":local"}, CreateOptions{}))
+	entries, err := client.ListAll(ctx)
+	require.NoError(err)
+	require.Equal([]StashEntry{
+		{Name: "component", Home: ProjectHome},
+		{Name: "component", Home: LocalHome, Shadowed: true},
+	}, entries)
+	require.Equal("project:component", entries[0].Ref())
+
+	expand := func(ref string) string {
+		dst := filepath.Join(homeDir1, randTemp())
+		require.NoError(client.Expand(ctx, ref, dst, ExpandOptions{}))
+		names, err := ioutil.ReadDir(dst)
+		require.NoError(err)
+		require.Len(names, 1)
+		return names[0].Name()
+	}
+	require.Equal("team", expand("component"))
+	require.Equal("team", expand("project:component"))
+	require.Equal("local", expand("local:component"))
+
+	err = client.Delete(ctx, "project:component")
+	require.True(errors.Is(err, ErrReadOnlyHome))
+	_, err = ParseSearchPath([]string{"project=" + homeDir1})
+	require.Equal(ErrInvalidSearchHome, err)
+}
+
+func Test_searchPath(t *testing.T) {
+	require := require.New(t)
+	homeDir1 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir1))
+	}()
+	homeDir2 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir2))
+	}()
+	homeDir3 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir3))
+	}()
+	homeDir4 := filepath.Join(os.TempDir(), randTemp())
+	defer func() {
+		require.NoError(os.RemoveAll(homeDir4))
+	}()
+	require.NoError(createSampleTreeWithTemplates(homeDir1))
+	ctx := context.Background()
+
+	homes, err := ParseSearchPath([]string{"team=" + homeDir4, homeDir2, " "})
+	require.NoError(err)
+	require.Equal([]SearchHome{{Name: "team", Path: homeDir4}, {Name: filepath.Base(homeDir2), Path: homeDir2}}, homes)
+	_, err = ParseSearchPath([]string{"team=" + homeDir4, "team=" + homeDir2})
+	require.Equal(ErrInvalidSearchHome, err)
+	_, err = ParseSearchPath([]string{"local=" + homeDir4})
+	require.Equal(ErrInvalidSearchHome, err)
+
+	team, err := New(homeDir4)
+	require.NoError(err)
+	require.NoError(team.Create(ctx, "shared", []string{homeDir1 + ":team"}, CreateOptions{}))
+	require.NoError(team.Create(ctx, "only-team", []string{homeDir1}, CreateOptions{}))
+
+	// the second home of the search path does not exist
+	client, err := New(homeDir3, WithSearchPath(homes...))
+	require.NoError(err)
+	require.NoError(client.Create(ctx, "shared", []string{homeDir1 + ":local"}, CreateOptions{}))
+
+	entries, err := client.ListAll(ctx)
+	require.NoError(err)
+	require.Equal([]StashEntry{
+		{Name: "shared", Home: LocalHome},
+		{Name: "only-team", Home: "team"},
+		{Name: "shared", Home: "team", Shadowed: true},
+	}, entries)
+	require.Equal("team:shared", entries[2].Ref())
+
+	expand := func(ref string) string {
+		dst := filepath.Join(homeDir2, randTemp())
+		require.NoError(client.Expand(ctx, ref, dst, ExpandOptions{}))
+		names, err := ioutil.ReadDir(dst)
+		require.NoError(err)
+		require.Len(names, 1)
+		return names[0].Name()
+	}
+	require.Equal("local", expand("shared"))
+	require.Equal("team", expand("team:shared"))
+	require.Equal("local", expand("local:shared"))
+
+	m, err := client.Manifest(ctx, "only-team")
+	require.NoError(err)
+	require.Equal("only-team", m.Name)
+	_, err = client.Manifest(ctx, "nope:shared")
+	require.True(errors.Is(err, ErrSearchHomeNotExist))
+
+	err = client.Create(ctx, "team:new-stash", []string{homeDir1}, CreateOptions{})
+	require.True(errors.Is(err, ErrReadOnlyHome))
+	err = client.Delete(ctx, "team:shared")
+	require.True(errors.Is(err, ErrReadOnlyHome))
+
+	// copying brings a stash of the search path into the writable home
+	require.NoError(client.Copy(ctx, "team:shared", "mine"))
+	m, err = client.Manifest(ctx, "mine")
+	require.NoError(err)
+	require.Equal(homeDir4, m.Origin)
+	require.Len(m.Versions, 1)
+	entries, err = client.ListAll(ctx)
+	require.NoError(err)
+	require.Equal(StashEntry{Name: "mine", Home: LocalHome}, entries[0])
+	require.True(errors.Is(client.Copy(ctx, "team:shared", "mine"), ErrStashExists))
+
+	// the lock file records the home, so upgrade finds the same stash
+	dst := filepath.Join(homeDir2, randTemp())
+	require.NoError(client.Expand(ctx, "team:shared", dst, ExpandOptions{Lock: true}))
+	l, err := readLockFile(dst)
+	require.NoError(err)
+	require.Equal("team", l.Home)
+	require.NoError(ioutil.WriteFile(filepath.Join(homeDir1, "new.txt"), []byte("new"), 0644))
+	_, err = client.Update(ctx, "shared", "")
+	require.NoError(err)
+	changes, err := client.Upgrade(ctx, dst, UpgradeOptions{})
+	require.NoError(err)
+	require.Empty(changes)
+	_, err = client.Capture(ctx, "", dst, CaptureOptions{})
+	require.True(errors.Is(err, ErrReadOnlyHome))
+
+	// a stash without versions can not be locked in a read-only home
+	tm, err := readManifest(newDirStore(homeDir4), "only-team")
+	require.NoError(err)
+	tm.Version, tm.Versions = "", nil
+	require.NoError(writeManifest(newDirStore(homeDir4), tm))
+	dst = filepath.Join(homeDir2, randTemp())
+	err = client.Expand(ctx, "only-team", dst, ExpandOptions{Lock: true})
+	require.True(errors.Is(err, ErrReadOnlyHome))
+	_, err = os.Stat(dst)
+	require.True(os.IsNotExist(err))
+	tm, err = readManifest(newDirStore(homeDir4), "only-team")
+	require.NoError(err)
+	require.Empty(tm.Versions)
+}
@@ -0,0 +1,142 @@
+package fstash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// isGitRepo reports whether dir is the top of a git work tree.
+func isGitRepo(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// runGit runs git in dir and returns its trimmed output.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// readGitRef reads the files of a ref of a git repository, optionally only
+// those under a directory of it.
+func readGitRef(ctx context.Context, repo, ref, subdir string) (map[string]*archiveEntry, error) {
+	if strings.HasPrefix(ref, "-") {
+		// git archive would take it for an option
+		return nil, ErrInvalidGitRef
+	}
+	treeish := ref
+	if subdir = strings.Trim(filepath.ToSlash(subdir), "/"); subdir != "" {
+		treeish += ":" + subdir
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "-C", repo, "archive", "--format=tar", treeish)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git archive %s: %v: %s", treeish, err, strings.TrimSpace(stderr.String()))
+	}
+	return readTar(&stdout)
+}
+
+// commitHome commits all the changes of fstash home, when it is a git
+// repository, and tags the current versions of the stashes of the store as
+// name/version.
+func commitHome(ctx context.Context, fstashHome string, store Store, message string, stashNames ...string) error {
+	if !isGitRepo(fstashHome) {
+		return nil
+	}
+	if _, err := runGit(ctx, fstashHome, "add", "-A"); err != nil {
+		return err
+	}
+	status, err := runGit(ctx, fstashHome, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if status != "" {
+		args := gitIdentity(ctx, fstashHome)
+		args = append(args, "commit", "--quiet", "-m", message)
+		if _, err := runGit(ctx, fstashHome, args...); err != nil {
+			return err
+		}
+	}
+	for _, name := range stashNames {
+		m, err := readManifest(store, polishStashName(name))
+		if err != nil {
+			return err
+		}
+		if m.Version == "" {
+			continue
+		}
+		if _, err := runGit(ctx, fstashHome, "tag", "-f", m.Name+"/"+m.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitIdentity falls back to a committer for fstash when git has none
+// configured.
+func gitIdentity(ctx context.Context, dir string) []string {
+	if email, err := runGit(ctx, dir, "config", "user.email"); err == nil && email != "" {
+		return nil
+	}
+	return []string{"-c", "user.name=fstash", "-c", "user.email=fstash@localhost"}
+}
+
+// gitStash imports a ref of a git repository, a local path or a URL, into a
+// stash of the fstash home inside cacheDir, so it can be expanded. Repositories
+// at a URL are mirrored into cacheDir and updated when they can be reached.
+// It returns the store of that fstash home and the name of the stash.
+func gitStash(ctx context.Context, repo, ref, subdir, cacheDir string) (Store, string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	src, err := expandUserHome(repo)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := os.Stat(src); err == nil {
+		if src, err = filepath.Abs(src); err != nil {
+			return nil, "", err
+		}
+	} else {
+		src = filepath.Join(cacheDir, "mirrors", digestOf([]byte(repo))[:16])
+		if err := os.MkdirAll(filepath.Dir(src), 0777); err != nil {
+			return nil, "", err
+		}
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			if _, err := runGit(ctx, cacheDir, "clone", "--mirror", "--quiet", "--", repo, src); err != nil {
+				return nil, "", err
+			}
+		} else {
+			// when offline, the mirror is used as is
+			runGit(ctx, src, "remote", "update", "--prune")
+		}
+	}
+	entries, err := readGitRef(ctx, src, ref, subdir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	store := newDirStore(filepath.Join(cacheDir, "stashes"))
+	name := "git-" + digestOf([]byte(repo + "\x00" + ref + "\x00" + subdir))[:16]
+	if err := deleteStash(name, store); err != nil {
+		return nil, "", err
+	}
+	opts := importOptions{name: name}
+	if _, err := importEntries(entries, repo+"@"+ref, store, opts); err != nil {
+		return nil, "", err
+	}
+	return store, name, nil
+}
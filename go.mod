@@ -1,10 +1,17 @@
-module fstash
+module github.com/workshop-depot/fstash
+
+go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.0
 	github.com/alecthomas/kingpin v2.2.6+incompatible
 	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc // indirect
 	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/joho/godotenv v1.4.0
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.2.2
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/sys v0.0.0-20200923182605-d9f96fdee20d // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,210 @@
+package fstash
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Names of the homes of a search path
+const (
+	// LocalHome is the writable fstash home
+	LocalHome = "local"
+	// ProjectHome is the .fstash directory of the project
+	ProjectHome = "project"
+)
+
+// projectDir is the directory of project-scoped stashes, at the top of a
+// repository or in any directory above the working directory.
+const projectDir = ".fstash"
+
+// SearchHome is a read-only fstash home, like a mounted network share or a
+// checked out repository, searched for stashes after the writable one.
+type SearchHome struct {
+	// Name is used to refer to its stashes as name:stash
+	Name string
+	Path string
+}
+
+// ParseSearchPath parses homes given as name=path or just path, named by the
+// base name of the directory.
+func ParseSearchPath(entries []string) ([]SearchHome, error) {
+	var homes []SearchHome
+	seen := map[string]bool{LocalHome: true, ProjectHome: true}
+	for _, v := range entries {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		name, p := "", v
+		if i := strings.Index(v, "="); i >= 0 {
+			name, p = v[:i], v[i+1:]
+		}
+		p, err := expandUserHome(p)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			name = polishStashName(filepath.Base(p))
+		}
+		if !validateName(name) || seen[name] {
+			return nil, ErrInvalidSearchHome
+		}
+		seen[name] = true
+		homes = append(homes, SearchHome{Name: name, Path: p})
+	}
+	return homes, nil
+}
+
+// FindProjectHome looks for a .fstash directory in dir and the directories
+// above it, up to the top of the git repository dir is in. It returns "" when
+// there is none, and ignores fstashHome, which may be ~/.fstash.
+func FindProjectHome(dir, fstashHome string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	fstashHome, _ = filepath.Abs(fstashHome)
+	for {
+		p := filepath.Join(dir, projectDir)
+		if info, err := os.Stat(p); err == nil && info.IsDir() && p != fstashHome {
+			return p
+		}
+		if isGitRepo(dir) {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// splitHomeRef splits home:name. The home is empty when ref has none.
+func splitHomeRef(ref string) (homeName, stashName string) {
+	if i := strings.Index(ref, ":"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return "", ref
+}
+
+// resolve returns the home of the stash ref refers to, home:name or just
+// name, with the name of the stash. A name is looked up in the project home,
+// the writable home and then along the search path.
+func (c *Client) resolve(ref string) (SearchHome, string, error) {
+	homeName, name := splitHomeRef(ref)
+	if homeName == "" {
+		for _, h := range c.searchPath() {
+			ok, err := stashExists(c.storeOf(h), polishStashName(name))
+			if err != nil {
+				return SearchHome{}, "", err
+			}
+			if ok {
+				return h, name, nil
+			}
+		}
+		homeName = LocalHome
+	}
+	for _, h := range c.searchPath() {
+		if h.Name == homeName {
+			return h, name, nil
+		}
+	}
+	return SearchHome{}, "", ErrSearchHomeNotExist
+}
+
+// storeOf returns the store of a home: the store of the client for the
+// writable home and the directory layout of the others.
+func (c *Client) storeOf(h SearchHome) Store {
+	if h.Name == LocalHome {
+		return c.store
+	}
+	return newDirStore(h.Path)
+}
+
+// searchPath returns all homes in the order stashes are looked up: the
+// project, the writable home and then the search path.
+func (c *Client) searchPath() []SearchHome {
+	var homes []SearchHome
+	if c.project != "" {
+		homes = append(homes, SearchHome{Name: ProjectHome, Path: c.project})
+	}
+	homes = append(homes, SearchHome{Name: LocalHome, Path: c.home})
+	return append(homes, c.homes...)
+}
+
+// writable returns the name of the stash ref refers to, which must be in the
+// writable home.
+func writable(ref string) (string, error) {
+	homeName, name := splitHomeRef(ref)
+	if homeName != "" && homeName != LocalHome {
+		return "", ErrReadOnlyHome
+	}
+	return name, nil
+}
+
+// StashEntry is a stash found along the search path.
+type StashEntry struct {
+	Name string
+	// Home is the name of the fstash home holding it, LocalHome for the
+	// writable one
+	Home string
+	// Shadowed tells a stash of the same name comes earlier in the search
+	// path, so it is expanded only as home:name
+	Shadowed bool
+}
+
+// Ref returns how the stash is referred to, name for the stashes of the
+// writable home and home:name for the others.
+func (e StashEntry) Ref() string {
+	if e.Home == LocalHome {
+		return e.Name
+	}
+	return e.Home + ":" + e.Name
+}
+
+func (c *Client) listHomes() ([]StashEntry, error) {
+	var entries []StashEntry
+	seen := make(map[string]bool)
+	for _, h := range c.searchPath() {
+		// a home of the search path may be a share that is not mounted
+		if _, err := os.Stat(h.Path); os.IsNotExist(err) && h.Name != LocalHome {
+			continue
+		}
+		names, err := listStashes(c.storeOf(h))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			entries = append(entries, StashEntry{Name: name, Home: h.Name, Shadowed: seen[name]})
+			seen[name] = true
+		}
+	}
+	return entries, nil
+}
+
+// copyAcross copies a stash, with its versions, from the store of another
+// fstash home into the writable one. The copy records where it came from,
+// origin, like an import.
+func copyAcross(src Store, srcName string, dst Store, dstName, origin string) error {
+	dstName = polishStashName(dstName)
+	m, content, err := openStash(src, srcName)
+	if err != nil {
+		return err
+	}
+	for _, digest := range versionDigests(m) {
+		if hasBlob(dst, digest) {
+			continue
+		}
+		blob, err := getBlob(src, digest)
+		if err != nil {
+			return err
+		}
+		if _, err := putBlob(dst, blob); err != nil {
+			return err
+		}
+	}
+	m.Name = dstName
+	_, err = importStash(dst, m, content, origin, ConflictFail)
+	return err
+}
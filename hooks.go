@@ -0,0 +1,139 @@
+package fstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Hooks are shell commands run in the destination directory around expanding
+// a stash. They are templates themselves, executed with the expand data.
+type Hooks struct {
+	PreExpand  []string `json:"pre_expand,omitempty" yaml:"pre_expand,omitempty"`
+	PostExpand []string `json:"post_expand,omitempty" yaml:"post_expand,omitempty"`
+}
+
+func (h *Hooks) empty() bool {
+	return h == nil || (len(h.PreExpand) == 0 && len(h.PostExpand) == 0)
+}
+
+// hookData merges all template data into one, for rendering hook commands.
+// Keys are merged in sorted order, so later keys win on conflicts.
+func hookData(templatesData map[string]string) (map[string]interface{}, error) {
+	var keys []string
+	for k := range templatesData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	data := make(map[string]interface{})
+	for _, k := range keys {
+		raw := strings.TrimSpace(templatesData[k])
+		if raw == "" {
+			continue
+		}
+		part := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(raw), &part); err != nil {
+			return nil, err
+		}
+		for pk, pv := range part {
+			data[pk] = pv
+		}
+	}
+	return data, nil
+}
+
+// renderHooks renders the hook commands with the data. Every value an action
+// prints is shell quoted, so data can not add commands of its own, and like in
+// templates a field missing from the data is an error.
+func renderHooks(commands []string, data map[string]interface{}) ([]string, error) {
+	var result []string
+	for _, v := range commands {
+		t, err := template.New("hook").Option("missingkey=error").Funcs(template.FuncMap{quoteFunc: shellQuote}).Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		for _, tt := range t.Templates() {
+			if tt.Tree != nil {
+				quoteActions(tt.Tree.Root)
+			}
+		}
+		b := &bytes.Buffer{}
+		if err := t.Execute(b, data); err != nil {
+			return nil, err
+		}
+		result = append(result, b.String())
+	}
+	return result, nil
+}
+
+// quoteFunc is the name of shellQuote in hook templates.
+const quoteFunc = "fstash_shell_quote"
+
+// quoteActions appends shellQuote to the pipelines of the actions that print,
+// like html/template adds its escapers.
+func quoteActions(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, v := range n.Nodes {
+			quoteActions(v)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Args:     []parse.Node{parse.NewIdentifier(quoteFunc).SetTree(nil).SetPos(n.Pos)},
+		})
+	case *parse.IfNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	case *parse.RangeNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	case *parse.WithNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	}
+}
+
+// shellQuote quotes a value as one word of sh -c, or of cmd /C on Windows.
+func shellQuote(v interface{}) string {
+	s := fmt.Sprint(v)
+	if runtime.GOOS == "windows" {
+		return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runHooks runs the commands one by one in dir, streaming their output and
+// stopping at the first failure.
+func runHooks(commands []string, dir string, stdout, stderr io.Writer) error {
+	for _, v := range commands {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", v)
+		} else {
+			cmd = exec.Command("sh", "-c", v)
+		}
+		cmd.Dir = dir
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("hook %q: %w", v, err)
+		}
+	}
+	return nil
+}
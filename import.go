@@ -0,0 +1,314 @@
+package fstash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policies for importing a stash whose name is already taken
+const (
+	ConflictFail    = "fail"
+	ConflictRename  = "rename"
+	ConflictVersion = "version"
+	ConflictMerge   = "merge"
+)
+
+// importOptions holds the settings for importing stashes.
+type importOptions struct {
+	// name is the name of the imported stash, by default the name in the
+	// archive or the base name of the directory
+	name string
+	// onConflict is one of the conflict policies, by default fail. Merge adds
+	// the versions of the imported stash to the existing one.
+	onConflict string
+	// ref is a git ref to import, which makes the source a git repository
+	ref string
+	// subdir is a directory inside the git repository to import
+	subdir string
+}
+
+// importStashes imports the stashes of an archive made by export, a directory
+// holding such an archive extracted or just files to stash, or a ref of a
+// local git repository. The imported stashes record where they came from, so
+// their hooks ask for confirmation before running. It returns the names of
+// the imported stashes.
+func importStashes(ctx context.Context, src string, store Store, opts importOptions) ([]string, error) {
+	src, err := expandUserHome(src)
+	if err != nil {
+		return nil, err
+	}
+	if src, err = filepath.Abs(src); err != nil {
+		return nil, err
+	}
+	entries, err := readImportSource(ctx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	origin := src
+	if opts.ref != "" {
+		origin += "@" + opts.ref
+	}
+	if opts.name == "" && len(archivedStashes(entries)) == 0 {
+		opts.name = strings.TrimSuffix(filepath.Base(src), ".git")
+	}
+	return importEntries(entries, origin, store, opts)
+}
+
+// archivedStashes returns the sorted names of the stashes in the entries of
+// an archive made by export.
+func archivedStashes(entries map[string]*archiveEntry) []string {
+	var names []string
+	for name := range entries {
+		parts := strings.Split(name, "/")
+		if len(parts) == 3 && parts[0] == archiveStashes && parts[2] == archiveManifest {
+			names = append(names, parts[1])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// importEntries imports the stashes of the entries of an archive made by
+// export, or the entries as the files of one stash named by opts.
+func importEntries(entries map[string]*archiveEntry, origin string, store Store, opts importOptions) ([]string, error) {
+	switch opts.onConflict {
+	case "":
+		opts.onConflict = ConflictFail
+	case ConflictFail, ConflictRename, ConflictVersion, ConflictMerge:
+	default:
+		return nil, ErrUnknownConflict
+	}
+	names := archivedStashes(entries)
+	if len(names) == 0 {
+		m := &Manifest{Name: polishStashName(opts.name)}
+		name, err := importStash(store, m, entries, origin, opts.onConflict)
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	}
+	if opts.name != "" && len(names) > 1 {
+		return nil, ErrImportName
+	}
+
+	// blobs first, so the versions of the stashes can be checked against them
+	for name, entry := range entries {
+		if path.Dir(name) != archiveBlobs {
+			continue
+		}
+		if digestOf(entry.content) != path.Base(name) {
+			return nil, fmt.Errorf("%s: %w", name, ErrInvalidArchive)
+		}
+		if _, err := putBlob(store, entry.content); err != nil {
+			return nil, err
+		}
+	}
+
+	var imported []string
+	for _, name := range names {
+		m := &Manifest{}
+		if err := json.Unmarshal(entries[manifestKey(name)].content, m); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if !validateName(name) || polishStashName(m.Name) != name {
+			return nil, fmt.Errorf("%s: %w", name, ErrInvalidStashName)
+		}
+		if err := checkVersions(store, m); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		content := make(map[string]*archiveEntry)
+		prefix := contentPrefix(name)
+		for k, entry := range entries {
+			if strings.HasPrefix(k, prefix) {
+				content[strings.TrimPrefix(k, prefix)] = entry
+			}
+		}
+		if opts.name != "" {
+			m.Name = polishStashName(opts.name)
+		}
+		name, err := importStash(store, m, content, origin, opts.onConflict)
+		if err != nil {
+			return imported, fmt.Errorf("%s: %w", name, err)
+		}
+		imported = append(imported, name)
+	}
+	return imported, nil
+}
+
+// readImportSource reads the files of an archive, a directory or a ref of a
+// git repository.
+func readImportSource(ctx context.Context, src string, opts importOptions) (map[string]*archiveEntry, error) {
+	if opts.ref != "" {
+		return readGitRef(ctx, src, opts.ref, opts.subdir)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		content, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		return readArchive(content)
+	}
+	tree, err := readTree(src, ".git")
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*archiveEntry)
+	for dir, names := range tree {
+		for _, f := range names {
+			fp := filepath.Join(src, dir, f)
+			info, err := os.Lstat(fp)
+			if err != nil {
+				return nil, err
+			}
+			entry := &archiveEntry{mode: info.Mode()}
+			if info.Mode()&os.ModeSymlink != 0 {
+				entry.link, err = os.Readlink(fp)
+			} else {
+				entry.content, err = ioutil.ReadFile(fp)
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries[filepath.ToSlash(filepath.Join(dir, f))] = entry
+		}
+	}
+	return entries, nil
+}
+
+// checkVersions checks that the digest of every version matches its files,
+// that their paths and links stay inside the stash and that the content of
+// the files is in the blob store.
+func checkVersions(store Store, m *Manifest) error {
+	for _, v := range m.Versions {
+		if !validateVersion(v.Version) || filesDigest(v.Files, v.Links) != v.Digest {
+			return ErrInvalidArchive
+		}
+		for rel, target := range v.Links {
+			if err := checkEntryName(rel); err != nil {
+				return err
+			}
+			if err := checkLink(rel, target); err != nil {
+				return err
+			}
+		}
+		for rel, digest := range v.Files {
+			if err := checkEntryName(rel); err != nil {
+				return err
+			}
+			if !validDigest(digest) {
+				return ErrInvalidArchive
+			}
+			if !hasBlob(store, digest) {
+				return fmt.Errorf("%s: %w", rel, ErrBlobNotExist)
+			}
+		}
+	}
+	return nil
+}
+
+// importStash writes content as the stash of the manifest, resolving a taken
+// name with the conflict policy. The content must match the current version
+// of the manifest, if it has one. The files, the versions and the manifest are
+// written in one batch. It returns the name of the stash.
+func importStash(store Store, m *Manifest, content map[string]*archiveEntry, origin, onConflict string) (string, error) {
+	if !validateName(m.Name) {
+		return m.Name, ErrInvalidStashName
+	}
+	var current *Version
+	if m.Version != "" {
+		if current = m.findVersion(m.Version); current == nil {
+			return m.Name, ErrVersionNotExist
+		}
+	}
+	if err := checkEntries(content); err != nil {
+		return m.Name, err
+	}
+
+	exists, err := stashExists(store, m.Name)
+	if err != nil {
+		return m.Name, err
+	}
+	if exists {
+		switch onConflict {
+		case ConflictRename:
+			base := m.Name
+			for i := 2; exists; i++ {
+				m.Name = base + "-" + strconv.Itoa(i)
+				if exists, err = stashExists(store, m.Name); err != nil {
+					return m.Name, err
+				}
+			}
+			exists = false
+		case ConflictVersion, ConflictMerge:
+		default:
+			return m.Name, ErrStashExists
+		}
+	}
+
+	name := m.Name
+	return name, batch(store, func(tx Store) error {
+		stored, err := storeContent(tx, content)
+		if err != nil {
+			return err
+		}
+		if current != nil && stored.Digest != current.Digest {
+			return ErrInvalidArchive
+		}
+
+		merged := false
+		if exists {
+			// the imported content becomes the next version of the existing
+			// stash, or its current one when merging
+			existing, err := readManifest(tx, name)
+			if err != nil {
+				return err
+			}
+			if len(existing.Versions) == 0 {
+				if err := snapshotStash(tx, existing, ""); err != nil {
+					return err
+				}
+			}
+			if onConflict == ConflictMerge && current != nil {
+				for _, v := range m.Versions {
+					ev := existing.findVersion(v.Version)
+					if ev == nil {
+						existing.Versions = append(existing.Versions, v)
+					} else if ev.Digest != v.Digest {
+						return fmt.Errorf("%s: %w", v.Version, ErrVersionExists)
+					}
+				}
+				existing.Version = m.Version
+				merged = true
+			}
+			existing.Templates = m.Templates
+			existing.TemplatePatterns = m.TemplatePatterns
+			existing.Hooks = m.Hooks
+			existing.FileHooks = m.FileHooks
+			existing.DataTemplates = m.DataTemplates
+			m = existing
+		}
+		if err := writeContent(tx, name, content); err != nil {
+			return err
+		}
+		m.Sources = nil
+		m.Origin = origin
+		if (exists && !merged) || current == nil {
+			if err := snapshotContent(tx, content, m, ""); err != nil {
+				return err
+			}
+		}
+		return writeManifest(tx, m)
+	})
+}
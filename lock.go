@@ -0,0 +1,190 @@
+package fstash
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LockFileName is the file, in a directory a stash was expanded into, that
+// records where its content came from.
+const LockFileName = ".fstash.lock"
+
+// lockFile records the stash, the version and the data a directory was
+// expanded from, and the digests of the files as they were generated.
+type lockFile struct {
+	Stash string `json:"stash"`
+	// Home is the name of the home of the stash in the search path, when it
+	// was found along it
+	Home string `json:"home,omitempty"`
+	// Remote is the name of the remote the stash was fetched from, when it
+	// was expanded from one
+	Remote  string            `json:"remote,omitempty"`
+	Version string            `json:"version"`
+	Digest  string            `json:"digest"`
+	Data    map[string]string `json:"data,omitempty"`
+	// Redacted are the names of secret data values left out of Data
+	Redacted []string          `json:"redacted,omitempty"`
+	Files    map[string]string `json:"files,omitempty"`
+}
+
+// secretPattern matches names of data values that are secrets by default.
+var secretPattern = regexp.MustCompile(`(?i)(password|passwd|secret|token|api_?key|credential|private_?key)`)
+
+// redactSecrets returns a copy of the template data without secret values,
+// and the sorted names of the values left out. Values named in secrets, or
+// with names that look like secrets, are removed at any depth.
+func redactSecrets(templatesData map[string]string, secrets []string) (map[string]string, []string, error) {
+	if len(templatesData) == 0 {
+		return nil, nil, nil
+	}
+	isSecret := func(name string) bool {
+		for _, v := range secrets {
+			if strings.EqualFold(v, name) {
+				return true
+			}
+		}
+		return secretPattern.MatchString(name)
+	}
+	found := make(map[string]bool)
+	var redact func(v interface{}) interface{}
+	redact = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, kv := range v {
+				if isSecret(k) {
+					delete(v, k)
+					found[k] = true
+					continue
+				}
+				v[k] = redact(kv)
+			}
+		case []interface{}:
+			for i := range v {
+				v[i] = redact(v[i])
+			}
+		}
+		return v
+	}
+
+	result := make(map[string]string)
+	for k, raw := range templatesData {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		var data interface{}
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			return nil, nil, err
+		}
+		content, err := json.Marshal(redact(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		result[k] = string(content)
+	}
+	var redacted []string
+	for k := range found {
+		redacted = append(redacted, k)
+	}
+	sort.Strings(redacted)
+	return result, redacted, nil
+}
+
+// missingSecrets returns the names of secrets, sorted, that are not in the
+// template data at any depth.
+func missingSecrets(templatesData map[string]string, secrets []string) ([]string, error) {
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	found := make(map[string]bool)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, kv := range v {
+				found[k] = true
+				walk(kv)
+			}
+		case []interface{}:
+			for _, kv := range v {
+				walk(kv)
+			}
+		}
+	}
+	for _, raw := range templatesData {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		var data interface{}
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			return nil, err
+		}
+		walk(data)
+	}
+	var missing []string
+	for _, v := range secrets {
+		if !found[v] {
+			missing = append(missing, v)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// lockStatus compares the files of dir to the digests recorded in its lock
+// file, telling which ones were modified or deleted since they were generated.
+func lockStatus(dir string) ([]FileChange, error) {
+	l, err := readLockFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for p := range l.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var changes []FileChange
+	for _, p := range paths {
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				changes = append(changes, FileChange{p, "deleted"})
+				continue
+			}
+			return nil, err
+		}
+		if digestOf(content) != l.Files[p] {
+			changes = append(changes, FileChange{p, "modified"})
+		}
+	}
+	return changes, nil
+}
+
+func readLockFile(dir string) (*lockFile, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, LockFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoLockFile
+		}
+		return nil, err
+	}
+	l := &lockFile{}
+	if err := json.Unmarshal(content, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func writeLockFile(dir string, l *lockFile) error {
+	content, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, LockFileName), append(content, '\n'), 0666)
+}
@@ -0,0 +1,100 @@
+package fstash
+
+import (
+	"encoding/json"
+	"path"
+)
+
+// Manifest holds what fstash knows about a stash besides its files. It is
+// kept apart from the files, in a json file next to the stash directory of
+// the directory layout, so the content of the stash stays exactly what was
+// stashed.
+type Manifest struct {
+	Name string `json:"name"`
+	// Meta describes the stash, its fields are kept next to name
+	Meta
+	Sources   []Source `json:"sources,omitempty"`
+	Templates []string `json:"templates,omitempty"`
+	// TemplatePatterns are the patterns Templates were found with
+	TemplatePatterns []string `json:"template_patterns,omitempty"`
+	// Ignore are glob patterns of files of the sources left out of the stash
+	Ignore []string `json:"ignore,omitempty"`
+	// Data is the default data of the templates, by template key, filled in
+	// field by field under the data given on expand
+	Data  map[string]string `json:"data,omitempty"`
+	Hooks *Hooks            `json:"hooks,omitempty"`
+	// FileHooks are the hooks of the stash files of the sources, run after
+	// Hooks and only once confirmed, like the hooks of an imported stash
+	FileHooks *Hooks `json:"file_hooks,omitempty"`
+	// DataTemplates makes any file data is given for a template, as it was
+	// for stashes created before templates were declared
+	DataTemplates bool `json:"data_templates,omitempty"`
+	// Origin tells where a stash came from, if it was not created locally
+	Origin string `json:"origin,omitempty"`
+	// Version is the latest version, which is the content of the stash directory
+	Version  string    `json:"version,omitempty"`
+	Versions []Version `json:"versions,omitempty"`
+}
+
+// allHooks returns Hooks followed by FileHooks.
+func (m *Manifest) allHooks() *Hooks {
+	if m.FileHooks.empty() {
+		return m.Hooks
+	}
+	all := &Hooks{}
+	if m.Hooks != nil {
+		all.PreExpand = append(all.PreExpand, m.Hooks.PreExpand...)
+		all.PostExpand = append(all.PostExpand, m.Hooks.PostExpand...)
+	}
+	all.PreExpand = append(all.PreExpand, m.FileHooks.PreExpand...)
+	all.PostExpand = append(all.PostExpand, m.FileHooks.PostExpand...)
+	return all
+}
+
+func (m *Manifest) isTemplate(rel string) bool {
+	for _, v := range m.Templates {
+		if v == rel {
+			return true
+		}
+	}
+	return false
+}
+
+func manifestPath(fstashHome, stashName string) string {
+	return stashDir(fstashHome, stashName) + ".json"
+}
+
+// manifestKey is the key of the manifest of a stash in a store.
+func manifestKey(stashName string) string {
+	return path.Join(archiveStashes, stashName, archiveManifest)
+}
+
+// readManifest returns the manifest of the stash. Stashes created before
+// manifests existed get an empty one, with DataTemplates set.
+func readManifest(store Store, stashName string) (*Manifest, error) {
+	content, _, err := store.Get(manifestKey(stashName))
+	if err != nil {
+		if err != ErrKeyNotExist {
+			return nil, err
+		}
+		keys, err := store.List(contentPrefix(stashName))
+		if err != nil {
+			return nil, err
+		}
+		return &Manifest{Name: stashName, DataTemplates: len(keys) > 0}, nil
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, err
+	}
+	m.Name = stashName
+	return m, nil
+}
+
+func writeManifest(store Store, m *Manifest) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(manifestKey(m.Name), content, 0644)
+}
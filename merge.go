@@ -0,0 +1,110 @@
+package fstash
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// merge3 merges the changes from base to ours and from base to theirs, line
+// by line. Conflicting changes are marked the way git marks them and the
+// second result is true if there were any.
+func merge3(base, ours, theirs []string, oursLabel, theirsLabel string) ([]string, bool) {
+	var result []string
+	conflict := false
+	iz, ia, ib := 0, 0, 0
+	for _, r := range syncRegions(base, ours, theirs) {
+		if r.aStart > ia || r.bStart > ib {
+			a, b, z := ours[ia:r.aStart], theirs[ib:r.bStart], base[iz:r.zStart]
+			equalA, equalB := sameLines(a, z), sameLines(b, z)
+			switch {
+			case sameLines(a, b), equalB:
+				result = append(result, a...)
+			case equalA:
+				result = append(result, b...)
+			default:
+				conflict = true
+				result = append(result, "<<<<<<< "+oursLabel+"\n")
+				result = append(result, ensureNewline(a)...)
+				result = append(result, "=======\n")
+				result = append(result, ensureNewline(b)...)
+				result = append(result, ">>>>>>> "+theirsLabel+"\n")
+			}
+		}
+		result = append(result, base[r.zStart:r.zEnd]...)
+		iz, ia, ib = r.zEnd, r.aStart+r.zEnd-r.zStart, r.bStart+r.zEnd-r.zStart
+	}
+	return result, conflict
+}
+
+// syncRegion is a range of base lines left unchanged on both sides.
+type syncRegion struct {
+	zStart, zEnd   int
+	aStart, bStart int
+}
+
+func syncRegions(base, a, b []string) []syncRegion {
+	am := difflib.NewMatcherWithJunk(base, a, false, nil).GetMatchingBlocks()
+	bm := difflib.NewMatcherWithJunk(base, b, false, nil).GetMatchingBlocks()
+	var regions []syncRegion
+	for ia, ib := 0, 0; ia < len(am) && ib < len(bm); {
+		x, y := am[ia], bm[ib]
+		start, end := x.A, x.A+x.Size
+		if y.A > start {
+			start = y.A
+		}
+		if y.A+y.Size < end {
+			end = y.A + y.Size
+		}
+		if start < end {
+			regions = append(regions, syncRegion{
+				zStart: start,
+				zEnd:   end,
+				aStart: x.B + start - x.A,
+				bStart: y.B + start - y.A,
+			})
+		}
+		if x.A+x.Size < y.A+y.Size {
+			ia++
+		} else {
+			ib++
+		}
+	}
+	return append(regions, syncRegion{zStart: len(base), zEnd: len(base), aStart: len(a), bStart: len(b)})
+}
+
+// lines splits content into lines, keeping the line endings.
+func lines(content []byte) []string {
+	var result []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n') + 1
+		if i == 0 {
+			i = len(content)
+		}
+		result = append(result, string(content[:i]))
+		content = content[i:]
+	}
+	return result
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ensureNewline(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	result := append([]string{}, lines...)
+	result[len(result)-1] += "\n"
+	return result
+}
@@ -0,0 +1,129 @@
+package fstash
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Meta describes a stash, to find it among many.
+type Meta struct {
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	Homepage    string   `json:"homepage,omitempty"`
+}
+
+// polishMeta trims the fields and turns the tags into a sorted set of lower
+// case names, like stash names.
+func polishMeta(meta Meta) (Meta, error) {
+	meta.Description = strings.TrimSpace(meta.Description)
+	meta.Author = strings.TrimSpace(meta.Author)
+	meta.Homepage = strings.TrimSpace(meta.Homepage)
+	if meta.Homepage != "" {
+		u, err := url.Parse(meta.Homepage)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Meta{}, ErrInvalidHomepage
+		}
+	}
+	seen := make(map[string]bool)
+	var tags []string
+	for _, v := range meta.Tags {
+		v = polishStashName(strings.TrimSpace(v))
+		if !validateName(v) {
+			return Meta{}, ErrInvalidTag
+		}
+		if !seen[v] {
+			seen[v] = true
+			tags = append(tags, v)
+		}
+	}
+	sort.Strings(tags)
+	meta.Tags = tags
+	return meta, nil
+}
+
+// withMeta returns meta with the fields set in other replaced.
+func withMeta(meta, other Meta) Meta {
+	if other.Description != "" {
+		meta.Description = other.Description
+	}
+	if len(other.Tags) > 0 {
+		meta.Tags = other.Tags
+	}
+	if other.Author != "" {
+		meta.Author = other.Author
+	}
+	if other.Homepage != "" {
+		meta.Homepage = other.Homepage
+	}
+	return meta
+}
+
+// setMeta replaces the metadata of a stash.
+func setMeta(stashName string, store Store, meta Meta) error {
+	stashName = polishStashName(stashName)
+	if ok, err := stashExists(store, stashName); err != nil {
+		return err
+	} else if !ok {
+		return ErrStashNotExist
+	}
+	m, err := readManifest(store, stashName)
+	if err != nil {
+		return err
+	}
+	if m.Meta, err = polishMeta(meta); err != nil {
+		return err
+	}
+	return writeManifest(store, m)
+}
+
+// SearchResult is a stash matching a search, with where it matched.
+type SearchResult struct {
+	StashEntry
+	Description string
+	// Fields are the ones of name, description and tags that matched
+	Fields []string
+	// Files are the paths of the files of the stash that matched
+	Files []string
+}
+
+// searchStash matches text, case insensitive, against the name, the
+// description, the tags and the file paths of a stash. It returns nil when
+// nothing matched.
+func searchStash(store Store, e StashEntry, text string) (*SearchResult, error) {
+	m, err := readManifest(store, e.Name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := contentPrefix(e.Name)
+	keys, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	text = strings.ToLower(text)
+	contains := func(s string) bool { return strings.Contains(strings.ToLower(s), text) }
+	r := &SearchResult{StashEntry: e, Description: m.Description}
+	if contains(e.Name) {
+		r.Fields = append(r.Fields, "name")
+	}
+	if contains(m.Description) {
+		r.Fields = append(r.Fields, "description")
+	}
+	for _, v := range m.Tags {
+		if contains(v) {
+			r.Fields = append(r.Fields, "tags")
+			break
+		}
+	}
+	for _, key := range keys {
+		if rel := strings.TrimPrefix(key, prefix); contains(rel) {
+			r.Files = append(r.Files, rel)
+		}
+	}
+	if len(r.Fields) == 0 && len(r.Files) == 0 {
+		return nil, nil
+	}
+	sort.Strings(r.Files)
+	return r, nil
+}
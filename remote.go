@@ -0,0 +1,329 @@
+package fstash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// remotesFile holds the configured remotes, inside fstash home.
+const remotesFile = "remotes.json"
+
+// Remote is a stash server, as served by fstash serve.
+type Remote struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+}
+
+func readRemotes(fstashHome string) ([]Remote, error) {
+	content, err := ioutil.ReadFile(filepath.Join(fstashHome, remotesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var remotes []Remote
+	if err := json.Unmarshal(content, &remotes); err != nil {
+		return nil, err
+	}
+	return remotes, nil
+}
+
+// writeRemotes writes the remotes readable only by the user, as they hold
+// the tokens.
+func writeRemotes(fstashHome string, remotes []Remote) error {
+	sort.Slice(remotes, func(i, j int) bool { return remotes[i].Name < remotes[j].Name })
+	content, err := json.MarshalIndent(remotes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fstashHome, 0777); err != nil {
+		return err
+	}
+	fp := filepath.Join(fstashHome, remotesFile)
+	tmp := fp + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+func addRemote(fstashHome, name, rawURL, token string) error {
+	u, err := url.Parse(rawURL)
+	if !validateName(name) || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidRemote
+	}
+	remotes, err := readRemotes(fstashHome)
+	if err != nil {
+		return err
+	}
+	for _, r := range remotes {
+		if r.Name == name {
+			return ErrRemoteExists
+		}
+	}
+	remotes = append(remotes, Remote{Name: name, URL: strings.TrimSuffix(rawURL, "/"), Token: token})
+	return writeRemotes(fstashHome, remotes)
+}
+
+func removeRemote(fstashHome, name string) error {
+	remotes, err := readRemotes(fstashHome)
+	if err != nil {
+		return err
+	}
+	for i, r := range remotes {
+		if r.Name == name {
+			return writeRemotes(fstashHome, append(remotes[:i], remotes[i+1:]...))
+		}
+	}
+	return ErrRemoteNotExist
+}
+
+// parseRemoteRef splits remote/name[@version]. It reports false when ref has
+// no remote part.
+func parseRemoteRef(ref string) (remoteName, stashName, version string, ok bool) {
+	i := strings.Index(ref, "/")
+	if i < 0 {
+		return "", "", "", false
+	}
+	remoteName, stashName = ref[:i], ref[i+1:]
+	if j := strings.LastIndex(stashName, "@"); j >= 0 {
+		stashName, version = stashName[:j], stashName[j+1:]
+	}
+	return remoteName, polishStashName(stashName), version, true
+}
+
+// call sends a request to the remote and decodes a JSON response into out,
+// unless out is nil. It returns the body of the response.
+func (r *Remote) call(ctx context.Context, method, p string, body io.Reader, out interface{}) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.URL+p, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(content, &e) != nil || e.Error == "" {
+			e.Error = res.Status
+		}
+		if res.StatusCode == http.StatusNotFound && strings.HasPrefix(p, "/stashes/") {
+			return nil, fmt.Errorf("%s: %w", r.Name, ErrStashNotExist)
+		}
+		return nil, fmt.Errorf("%s: %s", r.Name, e.Error)
+	}
+	if out != nil {
+		if err := json.Unmarshal(content, out); err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+// pushStash sends a stash, with its versions, to the remote. Only the content
+// the remote does not have yet is sent. The versions are merged into the ones
+// the remote already has.
+func pushStash(ctx context.Context, stashName string, store Store, r *Remote) (*Manifest, error) {
+	stashName = polishStashName(stashName)
+	m, content, err := openStash(store, stashName)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Versions) == 0 {
+		err := batch(store, func(tx Store) error {
+			if err := snapshotContent(tx, content, m, ""); err != nil {
+				return err
+			}
+			return writeManifest(tx, m)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	digests, err := json.Marshal(versionDigests(m))
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	if _, err := r.call(ctx, http.MethodPost, "/blobs/missing", bytes.NewReader(digests), &missing); err != nil {
+		return nil, err
+	}
+	for _, digest := range missing {
+		blob, err := getBlob(store, digest)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.call(ctx, http.MethodPut, "/blobs/"+digest, bytes.NewReader(blob), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := exportArchive([]string{stashName}, store, buf, FormatTarGz, false); err != nil {
+		return nil, err
+	}
+	pushed := &Manifest{}
+	if _, err := r.call(ctx, http.MethodPut, "/stashes/"+stashName+"/archive?on-conflict="+ConflictMerge, buf, pushed); err != nil {
+		return nil, err
+	}
+	return pushed, nil
+}
+
+// pullStash fetches a stash, with its versions, from the remote and merges
+// them into the local one. Only the manifest and the blobs missing here are
+// downloaded, and the content is rebuilt from the blobs. With a version, that
+// version becomes the current content of the stash.
+func pullStash(ctx context.Context, stashName, version string, store Store, r *Remote) error {
+	stashName = polishStashName(stashName)
+	if !validateName(stashName) {
+		return ErrInvalidStashName
+	}
+	m := &Manifest{}
+	if _, err := r.call(ctx, http.MethodGet, "/stashes/"+stashName, nil, m); err != nil {
+		return err
+	}
+	if m.Name != stashName {
+		return ErrInvalidArchive
+	}
+	if version == "" {
+		version = m.Version
+	}
+	v := m.findVersion(version)
+	if v == nil {
+		if version != "" {
+			return ErrVersionNotExist
+		}
+		// stashes made before versions existed have no blobs to rebuild
+		// their content from
+		content, err := pullContent(ctx, stashName, r)
+		if err != nil {
+			return err
+		}
+		_, err = importStash(store, m, content, r.URL+"/stashes/"+stashName, ConflictMerge)
+		return err
+	}
+
+	for _, digest := range versionDigests(m) {
+		if !validDigest(digest) {
+			return ErrInvalidArchive
+		}
+		if hasBlob(store, digest) {
+			continue
+		}
+		blob, err := r.call(ctx, http.MethodGet, "/blobs/"+digest, nil, nil)
+		if err != nil {
+			return err
+		}
+		if digestOf(blob) != digest {
+			return ErrInvalidArchive
+		}
+		if _, err := putBlob(store, blob); err != nil {
+			return err
+		}
+	}
+	if err := checkVersions(store, m); err != nil {
+		return err
+	}
+
+	content := make(map[string]*archiveEntry)
+	for rel, digest := range v.Files {
+		blob, err := getBlob(store, digest)
+		if err != nil {
+			return err
+		}
+		content[rel] = &archiveEntry{mode: v.fileMode(rel), content: blob}
+	}
+	for rel, target := range v.Links {
+		content[rel] = &archiveEntry{mode: os.ModeSymlink | 0777, link: target}
+	}
+	m.Version = v.Version
+	m.Templates = v.Templates
+
+	_, err := importStash(store, m, content, r.URL+"/stashes/"+stashName, ConflictMerge)
+	return err
+}
+
+// pullContent downloads the content of a stash of the remote, without its
+// blobs.
+func pullContent(ctx context.Context, stashName string, r *Remote) (map[string]*archiveEntry, error) {
+	archive, err := r.call(ctx, http.MethodGet, "/stashes/"+stashName+"/archive?blobs=false", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	content := make(map[string]*archiveEntry)
+	prefix := contentPrefix(stashName)
+	for k, entry := range entries {
+		if strings.HasPrefix(k, prefix) {
+			content[strings.TrimPrefix(k, prefix)] = entry
+		}
+	}
+	return content, nil
+}
+
+// fetchStash makes sure the cache holds the stash of the remote, at version
+// or the current one, pulling it when the remote has something newer. When
+// the remote can not be reached a cached stash is used as is.
+func fetchStash(ctx context.Context, stashName, version string, cache Store, r *Remote) error {
+	stashName = polishStashName(stashName)
+	cached, _, cacheErr := openStash(cache, stashName)
+	remoteManifest := &Manifest{}
+	if _, err := r.call(ctx, http.MethodGet, "/stashes/"+stashName, nil, remoteManifest); err != nil {
+		if cacheErr == nil && (version == "" || cached.findVersion(version) != nil) {
+			return nil
+		}
+		return err
+	}
+	if cacheErr == nil {
+		if version == "" {
+			version = remoteManifest.Version
+		}
+		if v := cached.findVersion(cached.Version); v != nil && cached.Version == version {
+			if rv := remoteManifest.findVersion(version); rv != nil && rv.Digest == v.Digest {
+				return nil
+			}
+		}
+	}
+	return pullStash(ctx, stashName, version, cache, r)
+}
+
+// versionDigests returns the digests of the content of all versions, once.
+func versionDigests(m *Manifest) []string {
+	seen := make(map[string]bool)
+	digests := []string{}
+	for _, v := range m.Versions {
+		for _, digest := range v.Files {
+			if !seen[digest] {
+				seen[digest] = true
+				digests = append(digests, digest)
+			}
+		}
+	}
+	sort.Strings(digests)
+	return digests
+}
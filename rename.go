@@ -0,0 +1,62 @@
+package fstash
+
+// renameStash moves a stash to its new name. The files and the manifest are
+// written under the new name and removed from the old one in one batch.
+func renameStash(oldName, newName string, store Store) error {
+	oldName, newName = polishStashName(oldName), polishStashName(newName)
+	m, err := prepareStashMove(oldName, newName, store)
+	if err != nil {
+		return err
+	}
+	return batch(store, func(tx Store) error {
+		if err := moveStash(tx, m, newName); err != nil {
+			return err
+		}
+		return deleteStash(oldName, tx)
+	})
+}
+
+// copyStash copies a stash, with its versions, under a new name. The files
+// and the manifest of the copy are written in one batch.
+func copyStash(srcName, dstName string, store Store) error {
+	srcName, dstName = polishStashName(srcName), polishStashName(dstName)
+	m, err := prepareStashMove(srcName, dstName, store)
+	if err != nil {
+		return err
+	}
+	return batch(store, func(tx Store) error {
+		return moveStash(tx, m, dstName)
+	})
+}
+
+// moveStash writes the files and the manifest of the stash of m under a new
+// name, leaving the old ones in place.
+func moveStash(store Store, m *Manifest, dstName string) error {
+	content, err := readContent(store, m.Name)
+	if err != nil {
+		return err
+	}
+	if err := writeContent(store, dstName, content); err != nil {
+		return err
+	}
+	m.Name = dstName
+	return writeManifest(store, m)
+}
+
+// prepareStashMove checks both names and returns the manifest of the source.
+func prepareStashMove(srcName, dstName string, store Store) (*Manifest, error) {
+	if !validateName(srcName) || !validateName(dstName) {
+		return nil, ErrInvalidStashName
+	}
+	if ok, err := stashExists(store, srcName); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrStashNotExist
+	}
+	if ok, err := stashExists(store, dstName); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, ErrStashExists
+	}
+	return readManifest(store, srcName)
+}
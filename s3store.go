@@ -0,0 +1,239 @@
+package fstash
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3ModeHeader keeps the mode of a file as object metadata.
+const s3ModeHeader = "X-Amz-Meta-Fstash-Mode"
+
+// s3Store keeps the keys as objects of a bucket of S3, or of a server
+// compatible with it, under a prefix. Requests are path-style and signed with
+// AWS Signature Version 4.
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Store(endpoint, bucket, prefix, region, accessKey, secretKey string) *s3Store {
+	return &s3Store{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    http.DefaultClient,
+	}
+}
+
+func (s *s3Store) Put(key string, content []byte, mode os.FileMode) error {
+	header := http.Header{}
+	header.Set(s3ModeHeader, strconv.FormatUint(uint64(mode), 10))
+	_, _, err := s.do(http.MethodPut, s.prefix+key, nil, content, header)
+	return err
+}
+
+func (s *s3Store) Get(key string) ([]byte, os.FileMode, error) {
+	header, content, err := s.do(http.MethodGet, s.prefix+key, nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	mode, err := s3Mode(header)
+	return content, mode, err
+}
+
+func (s *s3Store) Stat(key string) (os.FileMode, error) {
+	header, _, err := s.do(http.MethodHead, s.prefix+key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return s3Mode(header)
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		_, content, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(content, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, _, err := s.do(http.MethodDelete, s.prefix+key, nil, nil, nil)
+	if err == ErrKeyNotExist {
+		return nil
+	}
+	return err
+}
+
+func s3Mode(header http.Header) (os.FileMode, error) {
+	v := header.Get(s3ModeHeader)
+	if v == "" {
+		return 0644, nil
+	}
+	mode, err := strconv.ParseUint(v, 10, 32)
+	return os.FileMode(mode), err
+}
+
+// do sends a signed request for an object, or for the bucket when key is
+// empty, and returns the header and the body of the response.
+func (s *s3Store) do(method, key string, query url.Values, body []byte, header http.Header) (http.Header, []byte, error) {
+	req, err := http.NewRequest(method, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	p := req.URL.Path + "/" + s.bucket
+	if key != "" {
+		p += "/" + key
+	}
+	req.URL.Path, req.URL.RawPath = p, s3Escape(p, false)
+	req.URL.RawQuery = query.Encode()
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signS3Request(req, body, s.region, s.accessKey, s.secretKey, time.Now().UTC())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode == http.StatusNotFound && key != "" {
+		return nil, nil, ErrKeyNotExist
+	}
+	if res.StatusCode >= 300 {
+		return nil, nil, fmt.Errorf("s3 %s %s: %s", method, key, res.Status)
+	}
+	return res.Header, content, nil
+}
+
+// signS3Request adds the headers of AWS Signature Version 4 to req.
+func signS3Request(req *http.Request, body []byte, region, accessKey, secretKey string, now time.Time) {
+	payloadHash := digestOf(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	signedHeaders, canonical := s3CanonicalRequest(req, payloadHash)
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + digestOf([]byte(canonical))
+	key := []byte("AWS4" + secretKey)
+	for _, v := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalRequest returns the signed headers and the canonical request of
+// req, as defined by AWS Signature Version 4.
+func s3CanonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	query := req.URL.Query()
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	signedHeaders := strings.Join(names, ";")
+	return signedHeaders, strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, and
+// slashes unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
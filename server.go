@@ -0,0 +1,261 @@
+package fstash
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxUploadSize limits the size of an uploaded archive.
+const maxUploadSize = 256 << 20
+
+// server exposes the stashes of a store over HTTP:
+//
+//	GET  /stashes                  names of the stashes
+//	GET  /stashes/<name>           manifest of a stash
+//	GET  /stashes/<name>/archive   the stash exported, ?format=zip for a zip
+//	                               and ?blobs=false to leave out the versions
+//	PUT  /stashes/<name>/archive   upload an exported stash as its new version,
+//	                               ?on-conflict=merge to add its versions
+//	POST /blobs/missing            the digests of a JSON list not stored yet
+//	GET  /blobs/<digest>           content of a file of a version
+//	PUT  /blobs/<digest>           store content of a file of a version
+//
+// All requests need an Authorization: Bearer <token> header.
+type server struct {
+	store Store
+	token string
+
+	mu sync.RWMutex
+}
+
+func newServer(store Store, token string) *server {
+	return &server{store: store, token: token}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := r.Method + " " + parts[0]
+	switch {
+	case parts[0] == "stashes" && len(parts) >= 2 && !validateName(polishStashName(parts[1])):
+		writeError(w, http.StatusBadRequest, ErrInvalidStashName)
+		return
+	case parts[0] == "blobs" && len(parts) == 2 && parts[1] != "missing" && !validDigest(parts[1]):
+		writeError(w, http.StatusBadRequest, ErrInvalidArchive)
+		return
+	}
+	switch {
+	case route == "GET stashes" && len(parts) == 1:
+		s.list(w)
+	case route == "GET stashes" && len(parts) == 2:
+		s.manifest(w, parts[1])
+	case route == "GET stashes" && len(parts) == 3 && parts[2] == "archive":
+		q := r.URL.Query()
+		s.download(w, parts[1], q.Get("format"), q.Get("blobs") != "false")
+	case route == "PUT stashes" && len(parts) == 3 && parts[2] == "archive":
+		s.upload(w, r, parts[1])
+	case route == "POST blobs" && len(parts) == 2 && parts[1] == "missing":
+		s.missingBlobs(w, r)
+	case route == "GET blobs" && len(parts) == 2:
+		s.getBlob(w, parts[1])
+	case route == "PUT blobs" && len(parts) == 2:
+		s.putBlob(w, r, parts[1])
+	case (parts[0] == "stashes" || parts[0] == "blobs") && len(parts) <= 3:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *server) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if s.token == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(s.token)) == 1
+}
+
+func (s *server) list(w http.ResponseWriter) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names, err := listStashes(s.store)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (s *server) manifest(w http.ResponseWriter, name string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, _, err := openStash(s.store, polishStashName(name))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (s *server) download(w http.ResponseWriter, name, format string, withBlobs bool) {
+	if format == "" {
+		format = FormatTarGz
+	}
+	s.mu.RLock()
+	buf := new(bytes.Buffer)
+	err := exportArchive([]string{name}, s.store, buf, format, withBlobs)
+	s.mu.RUnlock()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	contentType := "application/gzip"
+	if format == FormatZip {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+polishStashName(name)+"."+format+`"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// upload imports an archive made by export, holding only the named stash, as
+// the next version of that stash, or merges its versions into it.
+func (s *server) upload(w http.ResponseWriter, r *http.Request, name string) {
+	name = polishStashName(name)
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	entries, err := readArchive(content)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if names := archivedStashes(entries); len(names) != 1 || names[0] != name {
+		writeError(w, http.StatusBadRequest, ErrInvalidArchive)
+		return
+	}
+	// the content is checked again against the stash when it is imported
+	if err := checkEntries(entries); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	opts := importOptions{name: name, onConflict: ConflictVersion}
+	switch v := r.URL.Query().Get("on-conflict"); v {
+	case "", ConflictVersion:
+	case ConflictMerge:
+		opts.onConflict = v
+	default:
+		writeError(w, http.StatusBadRequest, ErrUnknownConflict)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := importEntries(entries, "upload from "+r.RemoteAddr, s.store, opts); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	m, err := readManifest(s.store, name)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, m)
+}
+
+func (s *server) missingBlobs(w http.ResponseWriter, r *http.Request) {
+	var digests []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUploadSize)).Decode(&digests); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	missing := []string{}
+	for _, digest := range digests {
+		if !validDigest(digest) {
+			writeError(w, http.StatusBadRequest, ErrInvalidArchive)
+			return
+		}
+		if !hasBlob(s.store, digest) {
+			missing = append(missing, digest)
+		}
+	}
+	writeJSON(w, http.StatusOK, missing)
+}
+
+func (s *server) getBlob(w http.ResponseWriter, digest string) {
+	s.mu.RLock()
+	content, err := getBlob(s.store, digest)
+	s.mu.RUnlock()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+func (s *server) putBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if digestOf(content) != digest {
+		writeError(w, http.StatusBadRequest, ErrInvalidArchive)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := putBlob(s.store, content); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statusOf maps the errors of fstash to HTTP status codes.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrStashNotExist), errors.Is(err, ErrVersionNotExist), errors.Is(err, ErrBlobNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, ErrStashExists), errors.Is(err, ErrVersionExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidStashName), errors.Is(err, ErrInvalidArchive),
+		errors.Is(err, ErrUnknownFormat), errors.Is(err, ErrInvalidVersion):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,131 @@
+package fstash
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Source is a file or a directory to stash and where it goes inside the stash.
+type Source struct {
+	Path string `json:"path"`
+	// Dst is a slash separated path inside the stash. For a directory it is
+	// the directory its content goes to. For a file it is the new file name,
+	// or a directory if it ends with a slash. Empty means the root of the stash.
+	Dst string `json:"dst,omitempty"`
+}
+
+// parseSource parses a src:dst pair. The :dst part is optional and a leading
+// ~ in src stands for the home directory of the user.
+func parseSource(spec string) (Source, error) {
+	vol := filepath.VolumeName(spec)
+	src, dst := spec[len(vol):], ""
+	if i := strings.LastIndex(src, ":"); i >= 0 {
+		src, dst = src[:i], src[i+1:]
+	}
+	src, err := expandUserHome(vol + src)
+	if err != nil {
+		return Source{}, err
+	}
+	if src == "" {
+		return Source{}, ErrInvalidSource
+	}
+	src, err = filepath.Abs(src)
+	if err != nil {
+		return Source{}, err
+	}
+	dst = filepath.ToSlash(dst)
+	if dst != "" {
+		isDir := strings.HasSuffix(dst, "/")
+		dst = path.Clean(dst)
+		if path.IsAbs(dst) || dst == ".." || strings.HasPrefix(dst, "../") {
+			return Source{}, ErrInvalidSource
+		}
+		if dst == "." {
+			dst = ""
+		} else if isDir {
+			dst += "/"
+		}
+	}
+	return Source{Path: src, Dst: dst}, nil
+}
+
+func expandUserHome(p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") && !strings.HasPrefix(p, `~\`) {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, p[1:]), nil
+}
+
+// readSources builds one combined tree of all sources, mapping slash separated
+// paths inside the stash to the files on disk. When sources overlap, the later
+// one wins.
+func readSources(sources []Source, dirToSkip ...string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, s := range sources {
+		info, err := os.Stat(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			dst := s.Dst
+			if dst == "" || strings.HasSuffix(dst, "/") {
+				dst += filepath.Base(s.Path)
+			}
+			files[dst] = s.Path
+			continue
+		}
+		tree, err := readTree(s.Path, dirToSkip...)
+		if err != nil {
+			return nil, err
+		}
+		for dir, names := range tree {
+			for _, f := range names {
+				rel := path.Join(strings.TrimSuffix(s.Dst, "/"), filepath.ToSlash(dir), f)
+				files[rel] = filepath.Join(s.Path, dir, f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// ignoreFiles removes the files matching any of the patterns.
+func ignoreFiles(files map[string]string, patterns []string) {
+	for rel := range files {
+		if matchAny(patterns, rel) {
+			delete(files, rel)
+		}
+	}
+}
+
+// readFiles reads files, as returned by readSources, keeping their modes.
+// Symlinks are read as symlinks.
+func readFiles(files map[string]string) (map[string]*archiveEntry, error) {
+	content := make(map[string]*archiveEntry)
+	for rel, src := range files {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(src)
+			if err != nil {
+				return nil, err
+			}
+			content[rel] = &archiveEntry{mode: os.ModeSymlink | 0777, link: target}
+			continue
+		}
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		content[rel] = &archiveEntry{mode: info.Mode().Perm(), content: data}
+	}
+	return content, nil
+}
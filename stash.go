@@ -1,24 +1,30 @@
-package main
+package fstash
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-	"text/template"
 )
 
+// readTree maps each directory under dir, relative to dir, to the names of its
+// files. When dir is a single file, the tree holds just that file under ".",
+// relative to the directory of the file.
 func readTree(dir string, dirToSkip ...string) (map[string][]string, error) {
-	_, err := os.Stat(dir)
+	info, err := os.Stat(dir)
 	if err != nil {
 		return nil, err
 	}
+	if !info.IsDir() {
+		return map[string][]string{".": {info.Name()}}, nil
+	}
 	skipper := make(map[string]*bool)
 	for _, v := range dirToSkip {
 		flag := true
@@ -62,11 +68,7 @@ func copyTree(tree map[string][]string, dstHome, srcHome string) error {
 			src := filepath.Join(srcDir, f)
 			dst := filepath.Join(dstDir, f)
 
-			content, err := ioutil.ReadFile(src)
-			if err != nil {
-				return err
-			}
-			if err := ioutil.WriteFile(dst, content, 0777); err != nil {
+			if err := copyFile(src, dst); err != nil {
 				return err
 			}
 		}
@@ -74,6 +76,47 @@ func copyTree(tree map[string][]string, dstHome, srcHome string) error {
 	return nil
 }
 
+// copyFile copies a file keeping its mode. Symlinks are copied as symlinks.
+func copyFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return writeSymlink(dst, target)
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileMode(dst, content, info.Mode().Perm())
+}
+
+// writeFileMode writes the file with the mode, also when it already exists,
+// replacing a symlink instead of writing through it.
+func writeFileMode(dst string, content []byte, mode os.FileMode) error {
+	if info, err := os.Lstat(dst); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(dst, content, mode); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
+
+func writeSymlink(dst, target string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
+
 func hash(name string) []byte {
 	h := fnv.New64a()
 	_, err := h.Write([]byte(name))
@@ -100,10 +143,47 @@ func validateName(stashName string) bool {
 	return regexp.MustCompile("^[a-zA-Z0-9-_]+$").MatchString(stashName)
 }
 
-// Errors
+// Errors of fstash. Client wraps them in *Error, test them with errors.Is.
 var (
-	errInvalidStashName = errors.New("invalid stash name")
-	errStashNotExist    = errors.New("stash does not exist")
+	ErrInvalidStashName   = errors.New("invalid stash name")
+	ErrStashNotExist      = errors.New("stash does not exist")
+	ErrStashExists        = errors.New("stash already exists")
+	ErrBinaryTemplate     = errors.New("binary file can not be a template")
+	ErrHooksNotConfirmed  = errors.New("hooks of the stash were not confirmed")
+	ErrFileNotInStash     = errors.New("file does not exist in the stash")
+	ErrNoFilesSelected    = errors.New("no files of the stash are selected")
+	ErrInvalidVersion     = errors.New("invalid version, only numbers, alphabet and . + - and _")
+	ErrVersionExists      = errors.New("version of the stash already exists")
+	ErrVersionNotExist    = errors.New("version of the stash does not exist")
+	ErrBlobNotExist       = errors.New("content of the file is missing from the blob store")
+	ErrNoLockFile         = errors.New("directory was not expanded with a lock file")
+	ErrNoSources          = errors.New("stash has no recorded sources to update from")
+	ErrUnknownFormat      = errors.New("unknown archive format, expected tar.gz or zip")
+	ErrInvalidSource      = errors.New("invalid source, expected src or src:dst with dst inside the stash")
+	ErrInvalidArchive     = errors.New("invalid archive, content does not match its digests")
+	ErrUnknownConflict    = errors.New("unknown conflict policy, expected fail, rename, version or merge")
+	ErrImportName         = errors.New("a name can be given only when importing one stash")
+	ErrInvalidRemote      = errors.New("invalid remote, expected a name and an http or https URL")
+	ErrRemoteExists       = errors.New("remote already exists")
+	ErrRemoteNotExist     = errors.New("remote does not exist")
+	ErrKeyNotExist        = errors.New("key does not exist in the store")
+	ErrInvalidKey         = errors.New("invalid key for the store")
+	ErrUnknownStore       = errors.New("unknown store, expected dir, bolt, bolt:<path> or s3://bucket/prefix")
+	ErrInvalidRemoteRef   = errors.New("expected remote/name or remote/name@version")
+	ErrNoHome             = errors.New("home directory of the user is unknown, set FSTASH_HOME or --home")
+	ErrInvalidSearchHome  = errors.New("invalid search path, expected name=path or path with distinct names")
+	ErrSearchHomeNotExist = errors.New("home is not in the search path")
+	ErrReadOnlyHome       = errors.New("stashes of the search path are read-only")
+	ErrStashFileExists    = errors.New("directory already has a stash file")
+	ErrStashFileFormat    = errors.New("unknown stash file format, expected yaml or json")
+	ErrDataFileFormat     = errors.New("unknown data file format, expected json, yaml, toml or .env")
+	ErrInvalidTag         = errors.New("invalid tag, only numbers, alphabet and - and _")
+	ErrInvalidHomepage    = errors.New("invalid homepage, expected an http or https URL")
+	ErrPartialLock        = errors.New("a lock file can be written only when expanding the whole stash")
+	ErrSecretsMissing     = errors.New("secret data values left out of the lock file must be given again")
+	ErrInvalidGitRef      = errors.New("invalid git ref, it can not start with -")
+	ErrListedFileNotExist = errors.New("file listed in the stash file does not exist")
+	ErrVersionChanged     = errors.New("version of the stash is not the one the directory was expanded from")
 )
 
 func polishStashName(stashName string) string {
@@ -112,97 +192,524 @@ func polishStashName(stashName string) string {
 	return stashName
 }
 
-func createStash(stashName, stashTree, fstashHome string) error {
+func stashDir(fstashHome, stashName string) string {
+	parts := []string{fstashHome}
+	parts = append(parts, hashParts(hash(stashName))...)
+	parts = append(parts, stashName)
+	return filepath.Join(parts...)
+}
+
+func createStash(stashName, stashTree string, store Store) error {
+	return createStashWith(stashName, []string{stashTree}, store, createOptions{})
+}
+
+// createOptions holds the optional settings of a new stash.
+type createOptions struct {
+	// templates are glob patterns of the files that are templates
+	templates []string
+	// preExpand and postExpand are hook commands
+	preExpand  []string
+	postExpand []string
+	// version names the new version of the stash, by default the next number
+	version string
+	// ignore are glob patterns of files not to stash, also on update
+	ignore []string
+	// meta replaces the metadata of the stash, field by field when set
+	meta Meta
+}
+
+// createStashWith creates a stash from one or more files and directories,
+// each one given as src or src:dst (see parseSource). The files, the new
+// version and the manifest are written in one batch.
+func createStashWith(stashName string, sources []string, store Store, opts createOptions) error {
 	stashName = polishStashName(stashName)
 	if !validateName(stashName) {
-		return errInvalidStashName
+		return ErrInvalidStashName
+	}
+	var parsed []Source
+	for _, v := range sources {
+		s, err := parseSource(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v, err)
+		}
+		parsed = append(parsed, s)
 	}
-	tree, err := readTree(stashTree, ".git")
+	files, sf, err := readStashSources(parsed)
 	if err != nil {
 		return err
 	}
-	parts := []string{fstashHome}
-	parts = append(parts, hashParts(hash(stashName))...)
-	parts = append(parts, stashName)
-	dst := filepath.Join(parts...)
+	ignoreFiles(files, opts.ignore)
+	templates, err := findTemplates(files, append(append([]string(nil), opts.templates...), sf.Templates...))
+	if err != nil {
+		return err
+	}
+	data, err := sf.data()
+	if err != nil {
+		return err
+	}
+	m, err := readManifest(store, stashName)
+	if err != nil {
+		return err
+	}
+	meta, err := polishMeta(withMeta(m.Meta, opts.meta))
+	if err != nil {
+		return err
+	}
+	if opts.version != "" {
+		if !validateVersion(opts.version) {
+			return ErrInvalidVersion
+		}
+		if m.findVersion(opts.version) != nil {
+			return ErrVersionExists
+		}
+	}
+	added, err := readFiles(files)
+	if err != nil {
+		return err
+	}
+	content, err := readContent(store, stashName)
+	if err != nil {
+		return err
+	}
+	for rel, entry := range added {
+		content[rel] = entry
+	}
+	m.Sources = parsed
+	m.Templates = templates
+	m.TemplatePatterns = opts.templates
+	m.Meta = meta
+	m.Ignore = opts.ignore
+	m.Data = data
+	m.DataTemplates = false
+	m.Origin = ""
+	m.Hooks = nil
+	if len(opts.preExpand) > 0 || len(opts.postExpand) > 0 {
+		m.Hooks = &Hooks{PreExpand: opts.preExpand, PostExpand: opts.postExpand}
+	}
+	m.FileHooks = sf.Hooks
+	return batch(store, func(tx Store) error {
+		if err := putEntries(tx, stashName, added); err != nil {
+			return err
+		}
+		if err := snapshotContent(tx, content, m, opts.version); err != nil {
+			return err
+		}
+		return writeManifest(tx, m)
+	})
+}
 
-	return copyTree(tree, dst, stashTree)
+// findTemplates returns the sorted relative paths of the files matching any
+// of the patterns. Binary files can not be templates.
+func findTemplates(files map[string]string, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var templates []string
+	for rel, src := range files {
+		if !matchAny(patterns, rel) {
+			continue
+		}
+		content, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		if isBinary(content) {
+			return nil, fmt.Errorf("%s: %w", rel, ErrBinaryTemplate)
+		}
+		templates = append(templates, rel)
+	}
+	sort.Strings(templates)
+	return templates, nil
 }
 
-func expandTree(tree map[string][]string, dstHome, srcHome string, templatesData map[string]string) error {
-	for path, files := range tree {
-		for _, f := range files {
-			srcDir := filepath.Join(srcHome, path)
-			dstDir := filepath.Join(dstHome, path)
+// expandContent writes the content into dst, the files first and then the
+// symlinks, rendering the template files, see renderFile. It returns the
+// digests of the written files, by their expanded paths.
+func expandContent(content map[string]*archiveEntry, dst string, m *Manifest, templatesData map[string]string) (map[string]string, error) {
+	var files, links []string
+	for rel, entry := range content {
+		if entry.isLink() {
+			links = append(links, rel)
+		} else {
+			files = append(files, rel)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(links)
+	digests := make(map[string]string)
+	for _, rel := range files {
+		entry := content[rel]
+		rel, rendered, err := renderFile(rel, entry.content, m, templatesData)
+		if err != nil {
+			return nil, err
+		}
+		fp := filepath.Join(dst, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+			return nil, err
+		}
+		if err := writeFileMode(fp, rendered, entry.perm()); err != nil {
+			return nil, err
+		}
+		digests[rel] = digestOf(rendered)
+	}
+	for _, rel := range links {
+		fp := filepath.Join(dst, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+			return nil, err
+		}
+		if err := writeSymlink(fp, content[rel].link); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
 
-			if err := os.MkdirAll(dstDir, 0777); err != nil {
-				return err
-			}
+// renderFile returns the path and the content of a stash file as it gets
+// expanded. A file is a template if the manifest declares it, if it has the
+// .tmpl suffix - which gets stripped - or, for a stash with DataTemplates, if
+// data is given for its key.
+func renderFile(rel string, content []byte, m *Manifest, templatesData map[string]string) (string, []byte, error) {
+	isTemplate := m.isTemplate(rel)
+	if p := expandedPath(rel); p != rel {
+		rel = p
+		isTemplate = true
+	}
+	key := templateKey(rel)
+	if _, ok := templatesData[key]; ok && m.DataTemplates {
+		isTemplate = true
+	}
+	if !isTemplate {
+		return rel, content, nil
+	}
+	raw := strings.TrimSpace(templatesData[key])
+	if isBinary(content) {
+		return "", nil, fmt.Errorf("%s: %w", rel, ErrBinaryTemplate)
+	}
+	raw, err := mergeFields(templatesData[AllTemplates], raw)
+	if err != nil {
+		return "", nil, err
+	}
+	content, err = renderTemplate(key, content, raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return rel, content, nil
+}
 
-			src := filepath.Join(srcDir, f)
-			dst := filepath.Join(dstDir, f)
+// expandedPath is the path of a stash file once expanded, without the .tmpl
+// suffix of a template.
+func expandedPath(rel string) string {
+	if strings.HasSuffix(rel, templateExt) && path.Base(rel) != templateExt {
+		return strings.TrimSuffix(rel, templateExt)
+	}
+	return rel
+}
 
-			content, err := ioutil.ReadFile(src)
-			if err != nil {
-				return err
-			}
+func expandStash(stashName string, store Store, workingDirectory string, templatesData map[string]string) error {
+	return expandStashWith(stashName, store, workingDirectory, expandOptions{data: templatesData})
+}
 
-			base := filepath.Base(src)
-			key := strings.Replace(base, filepath.Ext(base), "", -1)
-			raw := strings.TrimSpace(templatesData[key])
-			if raw != "" {
-				t, err := template.New(key).Parse(string(content))
-				if err != nil {
-					return err
-				}
-				data := make(map[string]interface{})
-				if err := json.Unmarshal([]byte(raw), &data); err != nil {
-					return err
-				}
-				b := &bytes.Buffer{}
-				if err := t.Execute(b, data); err != nil {
+// expandOptions holds the optional settings for expanding a stash.
+type expandOptions struct {
+	// data maps template keys to json data
+	data map[string]string
+	// files are the paths inside the stash to expand, all of them if empty;
+	// hooks are not run when only some files are expanded
+	files []string
+	// only and exclude are glob patterns selecting what to expand
+	only, exclude []string
+	// lock writes a lock file into the destination, recording the stash,
+	// its version, the data and the digests of the expanded files
+	lock bool
+	// secrets are names of data values not to record in the lock file, on
+	// top of the ones that look like secrets
+	secrets []string
+	// home is the name of the home of the stash, recorded in the lock file
+	home string
+	// remote is the name of the remote the stash was fetched from, recorded
+	// in the lock file
+	remote string
+	// readOnly tells the stash is in a home that can not be changed, so a
+	// stash without versions can not be locked
+	readOnly bool
+	// noHooks skips running the hooks of the stash
+	noHooks bool
+	// confirm is asked, with the rendered commands, before running the hooks
+	// of a stash that came from somewhere else or from stash files; without
+	// it those hooks are not run
+	confirm func(m *Manifest, hooks *Hooks) bool
+	// stdout and stderr receive the output of hooks, os.Stdout and
+	// os.Stderr by default
+	stdout, stderr io.Writer
+}
+
+func expandStashWith(stashName string, store Store, workingDirectory string, opts expandOptions) error {
+	m, content, err := openStash(store, stashName)
+	if err != nil {
+		return err
+	}
+	partial := len(opts.files) > 0 || len(opts.only) > 0 || len(opts.exclude) > 0
+	if partial && opts.lock {
+		// upgrade would take the files left out as deleted ones
+		return ErrPartialLock
+	}
+	if opts.lock && m.Version == "" && opts.readOnly {
+		// the first version of the stash could not be recorded
+		return ErrReadOnlyHome
+	}
+	if content, err = selectContent(content, opts); err != nil {
+		return err
+	}
+	if opts.data, err = mergeData(m.Data, opts.data); err != nil {
+		return err
+	}
+
+	var preExpand, postExpand []string
+	if hooks := m.allHooks(); !opts.noHooks && !partial && !hooks.empty() {
+		data, err := hookData(opts.data)
+		if err != nil {
+			return err
+		}
+		if preExpand, err = renderHooks(hooks.PreExpand, data); err != nil {
+			return err
+		}
+		if postExpand, err = renderHooks(hooks.PostExpand, data); err != nil {
+			return err
+		}
+		rendered := &Hooks{PreExpand: preExpand, PostExpand: postExpand}
+		ask := m.Origin != "" || !m.FileHooks.empty()
+		if ask && (opts.confirm == nil || !opts.confirm(m, rendered)) {
+			return ErrHooksNotConfirmed
+		}
+	}
+	stdout, stderr := opts.stdout, opts.stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	if len(preExpand) > 0 {
+		if err := os.MkdirAll(workingDirectory, 0777); err != nil {
+			return err
+		}
+		if err := runHooks(preExpand, workingDirectory, stdout, stderr); err != nil {
+			return err
+		}
+	}
+
+	digests, err := expandContent(content, workingDirectory, m, opts.data)
+	if err != nil {
+		return err
+	}
+
+	if opts.lock {
+		if m.Version == "" {
+			// stashes created before versions existed get their first one here
+			err := batch(store, func(tx Store) error {
+				if err := snapshotContent(tx, content, m, ""); err != nil {
 					return err
 				}
-				content = b.Bytes()
-			}
-
-			if err := ioutil.WriteFile(dst, content, 0777); err != nil {
+				return writeManifest(tx, m)
+			})
+			if err != nil {
 				return err
 			}
 		}
+		data, redacted, err := redactSecrets(opts.data, opts.secrets)
+		if err != nil {
+			return err
+		}
+		l := &lockFile{
+			Stash:    m.Name,
+			Home:     opts.home,
+			Remote:   opts.remote,
+			Version:  m.Version,
+			Digest:   m.findVersion(m.Version).Digest,
+			Data:     data,
+			Redacted: redacted,
+			Files:    digests,
+		}
+		if err := writeLockFile(workingDirectory, l); err != nil {
+			return err
+		}
 	}
-	return nil
+
+	return runHooks(postExpand, workingDirectory, stdout, stderr)
 }
 
-func expandStash(stashName, fstashHome, workingDirectory string, templatesData map[string]string) error {
+// openStash returns the manifest and the content of a stash.
+func openStash(store Store, stashName string) (*Manifest, map[string]*archiveEntry, error) {
 	stashName = polishStashName(stashName)
-	parts := []string{fstashHome}
-	parts = append(parts, hashParts(hash(stashName))...)
-	parts = append(parts, stashName)
-	dir := filepath.Join(parts...)
-	_, err := os.Stat(dir)
+	content, err := readContent(store, stashName)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return errStashNotExist
+		return nil, nil, err
+	}
+	if len(content) == 0 {
+		if _, err := store.Stat(manifestKey(stashName)); err == ErrKeyNotExist {
+			return nil, nil, ErrStashNotExist
+		} else if err != nil {
+			return nil, nil, err
 		}
-		return err
 	}
 
-	parts = []string{fstashHome}
-	parts = append(parts, hashParts(hash(stashName))...)
-	parts = append(parts, stashName)
-	stashDir := filepath.Join(parts...)
+	m, err := readManifest(store, stashName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, content, nil
+}
+
+// contentPrefix is the prefix of the keys of the files of a stash.
+func contentPrefix(stashName string) string {
+	return path.Join(archiveStashes, stashName, archiveContent) + "/"
+}
+
+// readContent returns the files of a stash, by slash separated paths.
+func readContent(store Store, stashName string) (map[string]*archiveEntry, error) {
+	prefix := contentPrefix(stashName)
+	keys, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	content := make(map[string]*archiveEntry)
+	for _, key := range keys {
+		data, mode, err := store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		content[strings.TrimPrefix(key, prefix)] = newEntry(data, mode)
+	}
+	return content, nil
+}
 
-	tree, err := readTree(stashDir)
+// writeContent makes content the files of a stash, removing the others.
+func writeContent(store Store, stashName string, content map[string]*archiveEntry) error {
+	prefix := contentPrefix(stashName)
+	keys, err := store.List(prefix)
 	if err != nil {
 		return err
 	}
+	for _, key := range keys {
+		if _, ok := content[strings.TrimPrefix(key, prefix)]; ok {
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return putEntries(store, stashName, content)
+}
 
-	if len(templatesData) == 0 {
-		return copyTree(tree, workingDirectory, stashDir)
+// putEntries writes the entries as files of a stash, next to its others.
+func putEntries(store Store, stashName string, entries map[string]*archiveEntry) error {
+	for rel, entry := range entries {
+		var err error
+		if entry.isLink() {
+			err = store.Put(contentKey(stashName, rel), []byte(entry.link), os.ModeSymlink|0777)
+		} else {
+			err = store.Put(contentKey(stashName, rel), entry.content, entry.perm())
+		}
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return expandTree(tree, workingDirectory, stashDir, templatesData)
+// stashExists tells whether the store has a manifest or files for the stash.
+func stashExists(store Store, stashName string) (bool, error) {
+	if !validateName(stashName) {
+		return false, nil
+	}
+	if _, err := store.Stat(manifestKey(stashName)); err == nil {
+		return true, nil
+	} else if err != ErrKeyNotExist {
+		return false, err
+	}
+	keys, err := store.List(contentPrefix(stashName))
+	return len(keys) > 0, err
+}
+
+// selectContent keeps the files of the content selected by the files, only
+// and exclude options.
+func selectContent(content map[string]*archiveEntry, opts expandOptions) (map[string]*archiveEntry, error) {
+	var err error
+	if len(opts.files) > 0 {
+		if content, err = selectFiles(content, opts.files); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.only) > 0 || len(opts.exclude) > 0 {
+		content = filterContent(content, opts.only, opts.exclude)
+		if len(content) == 0 {
+			return nil, ErrNoFilesSelected
+		}
+	}
+	return content, nil
+}
+
+// selectFiles keeps only the given files of the content. A template file can
+// be named with or without its .tmpl suffix.
+func selectFiles(content map[string]*archiveEntry, files []string) (map[string]*archiveEntry, error) {
+	found := make(map[string]bool)
+	for _, v := range files {
+		found[filepath.ToSlash(filepath.Clean(v))] = false
+	}
+	result := make(map[string]*archiveEntry)
+	for rel, entry := range content {
+		for _, k := range []string{rel, strings.TrimSuffix(rel, templateExt)} {
+			if _, ok := found[k]; ok {
+				found[k] = true
+				result[rel] = entry
+				break
+			}
+		}
+	}
+	for _, v := range files {
+		k := filepath.ToSlash(filepath.Clean(v))
+		if !found[k] {
+			return nil, fmt.Errorf("%s: %w", k, ErrFileNotInStash)
+		}
+	}
+	return result, nil
+}
+
+// filterContent keeps the files of the content selected by the only and
+// exclude patterns, see selected.
+func filterContent(content map[string]*archiveEntry, only, exclude []string) map[string]*archiveEntry {
+	result := make(map[string]*archiveEntry)
+	for rel, entry := range content {
+		if selected(rel, only, exclude) {
+			result[rel] = entry
+		}
+	}
+	return result
+}
+
+// filterTree keeps the files of the tree selected by the only and exclude
+// patterns, see selected.
+func filterTree(tree map[string][]string, only, exclude []string) map[string][]string {
+	result := make(map[string][]string)
+	for dir, names := range tree {
+		for _, f := range names {
+			if selected(filepath.ToSlash(filepath.Join(dir, f)), only, exclude) {
+				result[dir] = append(result[dir], f)
+			}
+		}
+	}
+	return result
+}
+
+// selected tells whether rel matches any of the only patterns, or there are
+// none, and no exclude pattern. A template file matches with or without its
+// .tmpl suffix.
+func selected(rel string, only, exclude []string) bool {
+	match := func(patterns []string) bool {
+		return matchAny(patterns, rel) || matchAny(patterns, strings.TrimSuffix(rel, templateExt))
+	}
+	return (len(only) == 0 || match(only)) && !match(exclude)
 }
 
 func listDepth(dir string, depth int) ([]string, error) {
@@ -214,6 +721,9 @@ func listDepth(dir string, depth int) ([]string, error) {
 		if !inf.IsDir() {
 			return nil
 		}
+		if inf.Name() == ".git" {
+			return filepath.SkipDir
+		}
 		rel, err := filepath.Rel(dir, p)
 		if err != nil {
 			return err
@@ -238,18 +748,57 @@ func listDepth(dir string, depth int) ([]string, error) {
 	return result, nil
 }
 
-func deleteStash(stashName, fstashHome string) error {
-	stashName = polishStashName(stashName)
-	parts := []string{fstashHome}
-	parts = append(parts, hashParts(hash(stashName))...)
-	parts = append(parts, stashName)
-	dir := filepath.Join(parts...)
-	_, err := os.Stat(dir)
+// listStashDirs returns the names of the stash directories in fstashHome.
+func listStashDirs(fstashHome string) ([]string, error) {
+	if _, err := os.Stat(fstashHome); os.IsNotExist(err) {
+		return nil, nil
+	}
+	l, err := listDepth(fstashHome, 5)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+		return nil, err
+	}
+	var result []string
+	for _, v := range l {
+		if validateName(v) {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// listStashes returns the sorted names of the stashes in the store.
+func listStashes(store Store) ([]string, error) {
+	keys, err := store.List(archiveStashes + "/")
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, key := range keys {
+		_, name, _, err := parseKey(key)
+		if err != nil {
+			continue
+		}
+		if len(result) == 0 || result[len(result)-1] != name {
+			result = append(result, name)
 		}
-		return err
 	}
-	return os.RemoveAll(dir)
+	sort.Strings(result)
+	return result, nil
+}
+
+// deleteStash removes the files and the manifest of a stash in one batch.
+func deleteStash(stashName string, store Store) error {
+	stashName = polishStashName(stashName)
+	return batch(store, func(tx Store) error {
+		keys, err := tx.List(path.Join(archiveStashes, stashName) + "/")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
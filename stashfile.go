@@ -0,0 +1,316 @@
+package fstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Names of the file describing a directory to stash, looked up in this order
+const (
+	StashFileYAML = ".fstash.yaml"
+	StashFileJSON = ".fstash.json"
+)
+
+// StashFile describes what of a directory gets stashed. fstash init writes
+// one, to be edited, and create honors it for every directory it stashes:
+//
+//	files: [go.mod, main.go]
+//	templates: [main.go]
+//	variables:
+//	  main:
+//	    Name: ""
+//	ignore: ["*.log"]
+//	hooks:
+//	  post_expand: [go mod tidy]
+type StashFile struct {
+	// Files are the paths of the files to stash, relative to the directory;
+	// all of them when empty
+	Files []string `yaml:"files,omitempty" json:"files,omitempty"`
+	// Templates are glob patterns of template files
+	Templates []string `yaml:"templates,omitempty" json:"templates,omitempty"`
+	// Variables are the default data of the templates, by template key
+	Variables map[string]map[string]interface{} `yaml:"variables,omitempty" json:"variables,omitempty"`
+	// Ignore are glob patterns of files not to stash
+	Ignore []string `yaml:"ignore,omitempty" json:"ignore,omitempty"`
+	Hooks  *Hooks   `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+}
+
+// readStashFile reads the stash file of dir. It returns nil when there is none.
+func readStashFile(dir string) (*StashFile, error) {
+	for _, name := range []string{StashFileYAML, StashFileJSON} {
+		fp := filepath.Join(dir, name)
+		content, err := ioutil.ReadFile(fp)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sf := &StashFile{}
+		if name == StashFileJSON {
+			dec := json.NewDecoder(bytes.NewReader(content))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(sf)
+		} else {
+			err = yaml.UnmarshalStrict(content, sf)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fp, err)
+		}
+		return sf, nil
+	}
+	return nil, nil
+}
+
+// readStashSources is readSources honoring the stash files of the directory
+// sources, which are never stashed themselves. It returns the stash files
+// merged into one, with their paths inside the stash.
+func readStashSources(sources []Source) (map[string]string, *StashFile, error) {
+	files, err := readSources(sources, ".git")
+	if err != nil {
+		return nil, nil, err
+	}
+	merged := &StashFile{}
+	for _, s := range sources {
+		if info, err := os.Stat(s.Path); err != nil || !info.IsDir() {
+			continue
+		}
+		prefix := strings.TrimSuffix(s.Dst, "/")
+		delete(files, path.Join(prefix, StashFileYAML))
+		delete(files, path.Join(prefix, StashFileJSON))
+		sf, err := readStashFile(s.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sf == nil {
+			continue
+		}
+		if len(sf.Files) > 0 {
+			keep := make(map[string]bool)
+			for _, v := range sf.Files {
+				keep[filepath.Clean(filepath.Join(s.Path, v))] = true
+			}
+			listed := make(map[string]bool)
+			for rel, src := range files {
+				inside, err := filepath.Rel(s.Path, src)
+				if err == nil && !strings.HasPrefix(inside, "..") && !keep[src] {
+					delete(files, rel)
+				}
+				listed[src] = keep[src]
+			}
+			for _, v := range sf.Files {
+				if fp := filepath.Clean(filepath.Join(s.Path, v)); !listed[fp] {
+					return nil, nil, fmt.Errorf("%s: %w", fp, ErrListedFileNotExist)
+				}
+			}
+		}
+		merged.Templates = append(merged.Templates, prefixPatterns(prefix, sf.Templates)...)
+		merged.Ignore = append(merged.Ignore, prefixPatterns(prefix, sf.Ignore)...)
+		for k, v := range sf.Variables {
+			if merged.Variables == nil {
+				merged.Variables = make(map[string]map[string]interface{})
+			}
+			merged.Variables[k] = v
+		}
+		if !sf.Hooks.empty() {
+			if merged.Hooks == nil {
+				merged.Hooks = &Hooks{}
+			}
+			merged.Hooks.PreExpand = append(merged.Hooks.PreExpand, sf.Hooks.PreExpand...)
+			merged.Hooks.PostExpand = append(merged.Hooks.PostExpand, sf.Hooks.PostExpand...)
+		}
+	}
+	ignoreFiles(files, merged.Ignore)
+	return files, merged, nil
+}
+
+// prefixPatterns makes glob patterns relative to a directory of the stash. A
+// pattern without a slash matches base names anywhere, so it is kept as is.
+func prefixPatterns(prefix string, patterns []string) []string {
+	var result []string
+	for _, p := range patterns {
+		p = strings.TrimPrefix(filepath.ToSlash(p), "./")
+		if prefix != "" && strings.Contains(p, "/") {
+			p = prefix + "/" + p
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// data returns the variables as json data by template key, like the data
+// given on expand.
+func (sf *StashFile) data() (map[string]string, error) {
+	if len(sf.Variables) == 0 {
+		return nil, nil
+	}
+	data := make(map[string]string)
+	for k, v := range sf.Variables {
+		fields := make(map[string]interface{}, len(v))
+		for fk, fv := range v {
+			fields[fk] = jsonValue(fv)
+		}
+		content, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("variables %s: %v", k, err)
+		}
+		data[k] = string(content)
+	}
+	return data, nil
+}
+
+// generateStashFile describes the files of dir: all of them, the ones that
+// look like templates, with the variables they use, the ignore patterns and
+// empty hooks to fill in.
+func generateStashFile(dir string, ignore []string) (*StashFile, error) {
+	files, err := readSources([]Source{{Path: dir}}, ".git")
+	if err != nil {
+		return nil, err
+	}
+	ignoreFiles(files, ignore)
+	sf := &StashFile{Ignore: ignore, Hooks: &Hooks{}}
+	for rel, src := range files {
+		if rel == StashFileYAML || rel == StashFileJSON || rel == LockFileName {
+			continue
+		}
+		sf.Files = append(sf.Files, rel)
+		content, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		vars, ok := templateVariables(rel, content)
+		if !ok {
+			continue
+		}
+		if !strings.HasSuffix(rel, templateExt) {
+			sf.Templates = append(sf.Templates, rel)
+		}
+		if len(vars) == 0 {
+			continue
+		}
+		if sf.Variables == nil {
+			sf.Variables = make(map[string]map[string]interface{})
+		}
+		sf.Variables[templateKey(strings.TrimSuffix(rel, templateExt))] = vars
+	}
+	sort.Strings(sf.Files)
+	sort.Strings(sf.Templates)
+	return sf, nil
+}
+
+// templateVariables tells whether a file looks like a template, which is a
+// .tmpl file or a text file with actions that parses as one, and returns
+// default data for the fields it uses: an empty list for the ones it ranges
+// over, a map for the ones with fields of their own and "" for the others.
+func templateVariables(rel string, content []byte) (map[string]interface{}, bool) {
+	if isBinary(content) {
+		return nil, false
+	}
+	t, err := template.New(rel).Parse(string(content))
+	if err != nil {
+		return nil, strings.HasSuffix(rel, templateExt)
+	}
+	vars := make(map[string]interface{})
+	actions := false
+	if t.Tree != nil {
+		actions = walkVariables(t.Tree.Root, vars)
+	}
+	if !actions && !strings.HasSuffix(rel, templateExt) {
+		return nil, false
+	}
+	return vars, true
+}
+
+// walkVariables collects the fields of the data used by the nodes. Inside
+// range and with the dot is something else, so only their pipelines count. It
+// reports whether there is any action at all.
+func walkVariables(node parse.Node, vars map[string]interface{}) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		actions := false
+		for _, v := range n.Nodes {
+			if walkVariables(v, vars) {
+				actions = true
+			}
+		}
+		return actions
+	case *parse.ActionNode:
+		pipeVariables(n.Pipe, vars, "")
+	case *parse.IfNode:
+		pipeVariables(n.Pipe, vars, "")
+		walkVariables(n.List, vars)
+		walkVariables(n.ElseList, vars)
+	case *parse.RangeNode:
+		pipeVariables(n.Pipe, vars, []interface{}{})
+	case *parse.WithNode:
+		pipeVariables(n.Pipe, vars, "")
+	case *parse.TemplateNode:
+		pipeVariables(n.Pipe, vars, "")
+	default:
+		return false
+	}
+	return true
+}
+
+func pipeVariables(pipe *parse.PipeNode, vars map[string]interface{}, leaf interface{}) {
+	if pipe == nil {
+		return
+	}
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch a := arg.(type) {
+			case *parse.FieldNode:
+				setVariable(vars, a.Ident, leaf)
+			case *parse.PipeNode:
+				pipeVariables(a, vars, "")
+			}
+		}
+	}
+}
+
+// setVariable sets the default of a field, like Name.First, keeping the
+// maps of the fields seen before.
+func setVariable(vars map[string]interface{}, ident []string, leaf interface{}) {
+	for _, v := range ident[:len(ident)-1] {
+		m, ok := vars[v].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			vars[v] = m
+		}
+		vars = m
+	}
+	last := ident[len(ident)-1]
+	if _, ok := vars[last].(map[string]interface{}); !ok {
+		vars[last] = leaf
+	}
+}
+
+// writeStashFile writes sf into dir as name, yaml or json by its extension.
+func writeStashFile(dir, name string, sf *StashFile) error {
+	var content []byte
+	var err error
+	if name == StashFileJSON {
+		content, err = json.MarshalIndent(sf, "", "  ")
+		content = append(content, '\n')
+	} else {
+		content, err = yaml.Marshal(sf)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), content, 0666)
+}
@@ -0,0 +1,614 @@
+package fstash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store keeps stashes as files under slash separated keys, laid out like an
+// archive made by export:
+//
+//	stashes/<name>/manifest.json   manifest of a stash
+//	stashes/<name>/content/<path>  a file of a stash
+//	blobs/<digest>                 content of a file of a version
+//
+// A symlink is kept with os.ModeSymlink in its mode and its target as content.
+type Store interface {
+	Put(key string, content []byte, mode os.FileMode) error
+	// Get returns ErrKeyNotExist for a missing key.
+	Get(key string) ([]byte, os.FileMode, error)
+	// Stat returns the mode of the file of a key, or ErrKeyNotExist.
+	Stat(key string) (os.FileMode, error)
+	// List returns the sorted keys starting with prefix.
+	List(prefix string) ([]string, error)
+	// Delete removes the key, if it exists.
+	Delete(key string) error
+}
+
+// batchStore is a store that can make many changes at once, atomically.
+type batchStore interface {
+	Batch(fn func(Store) error) error
+}
+
+// batch runs fn with the changes it makes to the store made at once, when the
+// store can, or directly on the store otherwise.
+func batch(store Store, fn func(Store) error) error {
+	if b, ok := store.(batchStore); ok {
+		return b.Batch(fn)
+	}
+	return fn(store)
+}
+
+// stagedStore holds back the changes made to a store, so they can be made
+// all at once later on. A deleted key is kept as nil.
+type stagedStore struct {
+	base    Store
+	changes map[string]*memFile
+}
+
+func newStagedStore(base Store) *stagedStore {
+	return &stagedStore{base: base, changes: make(map[string]*memFile)}
+}
+
+func (s *stagedStore) Put(key string, content []byte, mode os.FileMode) error {
+	if _, _, _, err := parseKey(key); err != nil {
+		return err
+	}
+	s.changes[key] = &memFile{content: append([]byte(nil), content...), mode: mode}
+	return nil
+}
+
+func (s *stagedStore) Get(key string) ([]byte, os.FileMode, error) {
+	f, ok := s.changes[key]
+	if !ok {
+		return s.base.Get(key)
+	}
+	if f == nil {
+		return nil, 0, ErrKeyNotExist
+	}
+	return append([]byte(nil), f.content...), f.mode, nil
+}
+
+func (s *stagedStore) Stat(key string) (os.FileMode, error) {
+	f, ok := s.changes[key]
+	if !ok {
+		return s.base.Stat(key)
+	}
+	if f == nil {
+		return 0, ErrKeyNotExist
+	}
+	return f.mode, nil
+}
+
+func (s *stagedStore) List(prefix string) ([]string, error) {
+	base, err := s.base.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, key := range base {
+		if _, ok := s.changes[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for key, f := range s.changes {
+		if f != nil {
+			keys = append(keys, key)
+		}
+	}
+	return filterKeys(keys, prefix), nil
+}
+
+func (s *stagedStore) Delete(key string) error {
+	if _, _, _, err := parseKey(key); err != nil {
+		return err
+	}
+	s.changes[key] = nil
+	return nil
+}
+
+// contentKey is the key of a file of a stash.
+func contentKey(stashName, rel string) string {
+	return path.Join(archiveStashes, stashName, archiveContent, rel)
+}
+
+// copyStore copies all keys of src into dst, in one batch when dst can make
+// one, and returns the number of keys copied. The other keys of dst are left
+// alone.
+func copyStore(dst, src Store) (int, error) {
+	keys, err := src.List("")
+	if err != nil {
+		return 0, err
+	}
+	err = batch(dst, func(tx Store) error {
+		for _, key := range keys {
+			content, mode, err := src.Get(key)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(key, content, mode); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// OpenStore opens the store described by spec: dir, the default, for the
+// directory layout of fstash home, bolt for a single database file in it,
+// bolt:<path> or s3://bucket/prefix, configured by the usual AWS environment
+// variables and FSTASH_S3_ENDPOINT for S3-compatible servers.
+func OpenStore(spec, fstashHome string) (Store, error) {
+	store, err := openStore(spec, fstashHome, os.Getenv)
+	if err != nil || store != nil {
+		return store, err
+	}
+	return newDirStore(fstashHome), nil
+}
+
+// openStore opens the store described by spec, or returns nil for the default
+// directory layout of fstash home. The others are bolt, a single database
+// file in fstash home, or bolt:<path> and s3://bucket/prefix, configured by the
+// usual AWS environment variables and FSTASH_S3_ENDPOINT for S3-compatible
+// servers.
+func openStore(spec, fstashHome string, getenv func(string) string) (Store, error) {
+	switch {
+	case spec == "" || spec == "dir":
+		return nil, nil
+	case spec == "bolt":
+		return openBoltStore(filepath.Join(fstashHome, boltFile))
+	case strings.HasPrefix(spec, "bolt:"):
+		fp, err := expandUserHome(strings.TrimPrefix(spec, "bolt:"))
+		if err != nil {
+			return nil, err
+		}
+		return openBoltStore(fp)
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, ErrUnknownStore
+	}
+	endpoint := getenv("FSTASH_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	region := getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return newS3Store(endpoint, u.Host, prefix, region, getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_SECRET_ACCESS_KEY")), nil
+}
+
+// dirStore is the directory layout of fstash home: stashes in directories
+// sharded by the hash of their names, manifests next to them and the blob
+// store under blobs.
+type dirStore struct {
+	fstashHome string
+}
+
+func newDirStore(fstashHome string) *dirStore {
+	return &dirStore{fstashHome: fstashHome}
+}
+
+// Kinds of keys of a store
+const (
+	keyBlob = iota + 1
+	keyManifest
+	keyContent
+)
+
+// parseKey returns the kind of a key with the name of its stash and the path
+// inside it, or the digest of a blob as name.
+func parseKey(key string) (kind int, name, rel string, err error) {
+	parts := strings.SplitN(key, "/", 4)
+	switch {
+	case len(parts) == 2 && parts[0] == archiveBlobs && validDigest(parts[1]):
+		return keyBlob, parts[1], "", nil
+	case len(parts) == 3 && parts[0] == archiveStashes && validateName(parts[1]) && parts[2] == archiveManifest:
+		return keyManifest, parts[1], "", nil
+	case len(parts) == 4 && parts[0] == archiveStashes && validateName(parts[1]) && parts[2] == archiveContent:
+		if rel, err := cleanEntryName(parts[3]); err == nil {
+			return keyContent, parts[1], rel, nil
+		}
+	}
+	return 0, "", "", fmt.Errorf("%s: %w", key, ErrInvalidKey)
+}
+
+// locate returns the path of the file of a key, and for a file of a stash,
+// the directory of the stash and the path inside it.
+func (s *dirStore) locate(key string) (fp, dir, rel string, err error) {
+	kind, name, rel, err := parseKey(key)
+	switch kind {
+	case keyBlob:
+		return blobPath(s.fstashHome, name), "", "", nil
+	case keyManifest:
+		return manifestPath(s.fstashHome, name), "", "", nil
+	case keyContent:
+		dir := stashDir(s.fstashHome, name)
+		return filepath.Join(dir, filepath.FromSlash(rel)), dir, rel, nil
+	}
+	return "", "", "", err
+}
+
+// Put writes the file of a key. Manifests and blobs are written next to their
+// place and renamed into it, so they are never seen half written.
+func (s *dirStore) Put(key string, content []byte, mode os.FileMode) error {
+	fp, dir, _, err := s.locate(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	if mode&os.ModeSymlink != 0 {
+		return writeSymlink(fp, string(content))
+	}
+	if dir != "" {
+		return writeFileMode(fp, content, mode.Perm())
+	}
+	tmp := fp + ".tmp"
+	if err := writeFileMode(tmp, content, mode.Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+func (s *dirStore) Get(key string) ([]byte, os.FileMode, error) {
+	mode, err := s.Stat(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	fp, _, _, _ := s.locate(key)
+	if mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fp)
+		return []byte(target), mode, err
+	}
+	content, err := ioutil.ReadFile(fp)
+	return content, mode, err
+}
+
+func (s *dirStore) Stat(key string) (os.FileMode, error) {
+	fp, _, _, err := s.locate(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Lstat(fp)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return 0, ErrKeyNotExist
+	}
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return os.ModeSymlink | 0777, nil
+	}
+	return info.Mode().Perm(), nil
+}
+
+// List walks only the stash or the blobs a prefix is limited to.
+func (s *dirStore) List(prefix string) ([]string, error) {
+	var keys []string
+	var names []string
+	if parts := strings.SplitN(prefix, "/", 3); len(parts) == 3 && parts[0] == archiveStashes {
+		if validateName(parts[1]) {
+			names = []string{parts[1]}
+		}
+	} else if overlaps(prefix, archiveStashes+"/") {
+		var err error
+		if names, err = listStashDirs(s.fstashHome); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		if _, err := os.Stat(manifestPath(s.fstashHome, name)); err == nil {
+			keys = append(keys, path.Join(archiveStashes, name, archiveManifest))
+		}
+		tree, err := readTree(stashDir(s.fstashHome, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for dir, files := range tree {
+			for _, f := range files {
+				keys = append(keys, contentKey(name, filepath.ToSlash(filepath.Join(dir, f))))
+			}
+		}
+	}
+	if !overlaps(prefix, archiveBlobs+"/") {
+		return filterKeys(keys, prefix), nil
+	}
+	blobs := filepath.Join(s.fstashHome, archiveBlobs)
+	err := filepath.Walk(blobs, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == blobs {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && validDigest(info.Name()) {
+			keys = append(keys, path.Join(archiveBlobs, info.Name()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filterKeys(keys, prefix), nil
+}
+
+// overlaps tells whether some keys under dir may start with prefix.
+func overlaps(prefix, dir string) bool {
+	return strings.HasPrefix(prefix, dir) || strings.HasPrefix(dir, prefix)
+}
+
+// Delete removes the file of a key. The directory of a stash goes with its
+// last file.
+func (s *dirStore) Delete(key string) error {
+	fp, dir, rel, err := s.locate(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(fp); os.IsNotExist(err) {
+		return nil
+	}
+	if dir == "" {
+		return os.Remove(fp)
+	}
+	if err := removeFile(dir, rel); err != nil {
+		return err
+	}
+	if names, err := ioutil.ReadDir(dir); err == nil && len(names) == 0 {
+		return os.Remove(dir)
+	}
+	return nil
+}
+
+// removeFile removes a file of the stash in dir, and its parent directories
+// left empty.
+func removeFile(dir, rel string) error {
+	fp := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.Remove(fp); err != nil {
+		return err
+	}
+	for parent := filepath.Dir(fp); parent != dir; parent = filepath.Dir(parent) {
+		names, err := ioutil.ReadDir(parent)
+		if err != nil || len(names) > 0 {
+			return err
+		}
+		if err := os.Remove(parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch holds back the changes of fn and then makes them: the blobs first,
+// then the files of each changed stash, built next to its directory and
+// swapped into place, and the manifests last. When anything fails, the old
+// directories are put back. A failing fn changes nothing.
+func (s *dirStore) Batch(fn func(Store) error) error {
+	tx := newStagedStore(s)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	var keys []string
+	for key := range tx.changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var stashes []string
+	var manifests, blobs []string
+	content := make(map[string]map[string]*memFile)
+	for _, key := range keys {
+		kind, name, rel, _ := parseKey(key)
+		switch kind {
+		case keyBlob:
+			blobs = append(blobs, key)
+		case keyManifest:
+			manifests = append(manifests, key)
+		case keyContent:
+			if content[name] == nil {
+				content[name] = make(map[string]*memFile)
+				stashes = append(stashes, name)
+			}
+			content[name][rel] = tx.changes[key]
+		}
+	}
+	apply := func(key string) error {
+		if f := tx.changes[key]; f != nil {
+			return s.Put(key, f.content, f.mode)
+		}
+		return s.Delete(key)
+	}
+	for _, key := range blobs {
+		if f := tx.changes[key]; f != nil {
+			if err := apply(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	var swapped []string
+	restore := func() {
+		for i := len(swapped) - 1; i >= 0; i-- {
+			os.RemoveAll(swapped[i])
+			os.Rename(swapped[i]+".old", swapped[i])
+		}
+	}
+	for _, name := range stashes {
+		if err := s.swapContent(name, content[name]); err != nil {
+			restore()
+			return err
+		}
+		swapped = append(swapped, stashDir(s.fstashHome, name))
+	}
+	for _, key := range manifests {
+		if err := apply(key); err != nil {
+			restore()
+			return err
+		}
+	}
+	for _, dir := range swapped {
+		if err := os.RemoveAll(dir + ".old"); err != nil {
+			return err
+		}
+	}
+	for _, key := range blobs {
+		if tx.changes[key] == nil {
+			if err := apply(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// swapContent builds the files of a stash with the changes next to its
+// directory and puts them in its place, keeping the old directory with the
+// .old suffix. Stash names have no dots, so these never pass for stashes.
+func (s *dirStore) swapContent(stashName string, changes map[string]*memFile) error {
+	content, err := readContent(s, stashName)
+	if err != nil {
+		return err
+	}
+	for rel, f := range changes {
+		if f == nil {
+			delete(content, rel)
+		} else {
+			content[rel] = newEntry(f.content, f.mode)
+		}
+	}
+	dir := stashDir(s.fstashHome, stashName)
+	next, old := dir+".next", dir+".old"
+	if err := os.RemoveAll(next); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if len(content) > 0 {
+		if err := extractEntries(content, next); err != nil {
+			os.RemoveAll(next)
+			return err
+		}
+	}
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(next)
+		return err
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	if err := os.Rename(next, dir); err != nil {
+		os.RemoveAll(next)
+		os.Rename(old, dir)
+		return err
+	}
+	return nil
+}
+
+// memStore keeps everything in memory, for tests.
+type memStore struct {
+	mu    sync.RWMutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	content []byte
+	mode    os.FileMode
+}
+
+func newMemStore() *memStore {
+	return &memStore{files: make(map[string]memFile)}
+}
+
+func (s *memStore) Put(key string, content []byte, mode os.FileMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[key] = memFile{content: append([]byte(nil), content...), mode: mode}
+	return nil
+}
+
+func (s *memStore) Get(key string) ([]byte, os.FileMode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[key]
+	if !ok {
+		return nil, 0, ErrKeyNotExist
+	}
+	return append([]byte(nil), f.content...), f.mode, nil
+}
+
+func (s *memStore) Stat(key string) (os.FileMode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[key]
+	if !ok {
+		return 0, ErrKeyNotExist
+	}
+	return f.mode, nil
+}
+
+func (s *memStore) List(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.files {
+		keys = append(keys, key)
+	}
+	return filterKeys(keys, prefix), nil
+}
+
+func (s *memStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, key)
+	return nil
+}
+
+// Batch holds back the changes of fn and makes them under one lock.
+func (s *memStore) Batch(fn func(Store) error) error {
+	tx := newStagedStore(s)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, f := range tx.changes {
+		if f == nil {
+			delete(s.files, key)
+		} else {
+			s.files[key] = *f
+		}
+	}
+	return nil
+}
+
+// filterKeys returns the sorted keys starting with prefix.
+func filterKeys(keys []string, prefix string) []string {
+	result := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
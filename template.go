@@ -0,0 +1,50 @@
+package fstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// templateExt marks a file as a template by convention. It is stripped from
+// the file name on expand.
+const templateExt = ".tmpl"
+
+// templateKey is the key used to look up the data of a template file,
+// which is its base name without the extension.
+func templateKey(name string) string {
+	base := filepath.Base(name)
+	return strings.Replace(base, filepath.Ext(base), "", -1)
+}
+
+// isBinary uses the same heuristic as git: a NUL byte near the beginning of the
+// content means it is not text. Text in any encoding, like Latin-1, has none.
+func isBinary(content []byte) bool {
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return bytes.IndexByte(head, 0) >= 0
+}
+
+// renderTemplate executes content as a text template with raw json data. A
+// field missing from the data is an error, not <no value> in the output.
+func renderTemplate(name string, content []byte, raw string) ([]byte, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			return nil, err
+		}
+	}
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,93 @@
+package fstash
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+)
+
+// updateStash syncs the stash with the sources it was created from: new and
+// changed files are copied and files no longer in the sources are removed.
+// If anything changed, the result is recorded as a new version, named version
+// or the next number. The files, the version and the manifest are written in
+// one batch, so a failing update leaves the stash as it was.
+func updateStash(stashName string, store Store, version string) ([]FileChange, error) {
+	m, current, err := openStash(store, stashName)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Sources) == 0 {
+		return nil, ErrNoSources
+	}
+	if version != "" {
+		if !validateVersion(version) {
+			return nil, ErrInvalidVersion
+		}
+		if m.findVersion(version) != nil {
+			return nil, ErrVersionExists
+		}
+	}
+	files, sf, err := readStashSources(m.Sources)
+	if err != nil {
+		return nil, err
+	}
+	ignoreFiles(files, m.Ignore)
+	data, err := sf.data()
+	if err != nil {
+		return nil, err
+	}
+	patterns := append(append([]string(nil), m.TemplatePatterns...), sf.Templates...)
+
+	content, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FileChange
+	for rel, entry := range content {
+		cur, ok := current[rel]
+		if !ok {
+			changes = append(changes, FileChange{rel, "added"})
+			continue
+		}
+		if cur.isLink() != entry.isLink() || cur.link != entry.link || !bytes.Equal(cur.content, entry.content) {
+			changes = append(changes, FileChange{rel, "changed"})
+		}
+	}
+	for rel := range current {
+		if _, ok := content[rel]; !ok {
+			changes = append(changes, FileChange{rel, "removed"})
+		}
+	}
+	var templates []string
+	if len(patterns) > 0 {
+		if templates, err = findTemplates(files, patterns); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, v := range m.Templates {
+			if _, ok := files[v]; ok {
+				templates = append(templates, v)
+			}
+		}
+	}
+	// the stash files can change the stash without changing its files
+	if len(changes) == 0 && reflect.DeepEqual(data, m.Data) &&
+		reflect.DeepEqual(templates, m.Templates) && reflect.DeepEqual(sf.Hooks, m.FileHooks) {
+		return nil, nil
+	}
+	m.Data = data
+	m.Templates = templates
+	m.FileHooks = sf.Hooks
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	return changes, batch(store, func(tx Store) error {
+		if err := snapshotContent(tx, content, m, version); err != nil {
+			return err
+		}
+		if err := writeContent(tx, m.Name, content); err != nil {
+			return err
+		}
+		return writeManifest(tx, m)
+	})
+}
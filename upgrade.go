@@ -0,0 +1,193 @@
+package fstash
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// conflictSuffix is added to the name of the stash version of a file, when it
+// can not be merged into the file.
+const conflictSuffix = ".fstash-new"
+
+// upgradeOptions holds the optional settings for upgrading a directory.
+type upgradeOptions struct {
+	// version to upgrade to, the latest one by default
+	version string
+	// data is merged over the data recorded in the lock file
+	data map[string]string
+}
+
+// FileChange is what happened to a file.
+type FileChange struct {
+	Path   string
+	Action string
+}
+
+// upgradeDir brings the changes between the version of the stash recorded in
+// the lock file of dir and a newer one into dir. Both versions are rendered
+// with the recorded data and the given one, which has to hold the secrets
+// left out of the lock file, and changes to files that were modified in dir are
+// merged line by line. Conflicts are marked in the files, like git does.
+func upgradeDir(store Store, dir string, opts upgradeOptions) ([]FileChange, error) {
+	l, err := readLockFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := stashExists(store, l.Stash); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrStashNotExist
+	}
+	m, err := readManifest(store, l.Stash)
+	if err != nil {
+		return nil, err
+	}
+	base := m.findVersion(l.Version)
+	if opts.version == "" {
+		opts.version = m.Version
+	}
+	target := m.findVersion(opts.version)
+	if base == nil || target == nil {
+		return nil, ErrVersionNotExist
+	}
+	// a stash created again, or another one of the same name, has other
+	// content under the same version
+	if base.Digest != l.Digest {
+		return nil, fmt.Errorf("%s %s: %w", l.Stash, l.Version, ErrVersionChanged)
+	}
+
+	data, err := mergeData(m.Data, l.Data, opts.data)
+	if err != nil {
+		return nil, err
+	}
+	// the base has to render as it was generated, secrets included
+	missing, err := missingSecrets(data, l.Redacted)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: %w", strings.Join(missing, ", "), ErrSecretsMissing)
+	}
+	baseFiles, err := renderVersion(store, m, base, data)
+	if err != nil {
+		return nil, err
+	}
+	theirFiles, err := renderVersion(store, m, target, data)
+	if err != nil {
+		return nil, err
+	}
+	theirModes := make(map[string]os.FileMode)
+	for rel := range target.Files {
+		theirModes[expandedPath(rel)] = target.fileMode(rel)
+	}
+
+	var paths []string
+	for p := range baseFiles {
+		paths = append(paths, p)
+	}
+	for p := range theirFiles {
+		if _, ok := baseFiles[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	// versions can come from anywhere, nothing is written outside of dir
+	for _, p := range paths {
+		if err := checkEntryName(p); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []FileChange
+	for _, p := range paths {
+		b, inBase := baseFiles[p]
+		t, inTheirs := theirFiles[p]
+		fp := filepath.Join(dir, filepath.FromSlash(p))
+		o, err := ioutil.ReadFile(fp)
+		inOurs := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// files keep their modes, new ones get the mode of the stash version
+		mode := theirModes[p]
+		if inOurs {
+			info, err := os.Stat(fp)
+			if err != nil {
+				return nil, err
+			}
+			mode = info.Mode().Perm()
+		}
+
+		switch {
+		case sameFile(inBase, b, inTheirs, t), sameFile(inOurs, o, inTheirs, t):
+			continue
+		case sameFile(inOurs, o, inBase, b), inOurs && inBase && l.Files[p] == digestOf(o):
+			if !inTheirs {
+				if err := os.Remove(fp); err != nil {
+					return nil, err
+				}
+				changes = append(changes, FileChange{p, "deleted"})
+				continue
+			}
+			if err := writeFile(fp, t, mode); err != nil {
+				return nil, err
+			}
+			if inOurs {
+				changes = append(changes, FileChange{p, "updated"})
+			} else {
+				changes = append(changes, FileChange{p, "added"})
+			}
+		case inOurs && inTheirs && !isBinary(o) && !isBinary(t) && !isBinary(b):
+			merged, conflict := merge3(lines(b), lines(o), lines(t), "ours", "stash "+l.Stash+" "+target.Version)
+			if err := writeFile(fp, []byte(strings.Join(merged, "")), mode); err != nil {
+				return nil, err
+			}
+			if conflict {
+				changes = append(changes, FileChange{p, "conflict"})
+			} else {
+				changes = append(changes, FileChange{p, "merged"})
+			}
+		default:
+			if inTheirs {
+				if err := writeFile(fp+conflictSuffix, t, theirModes[p]); err != nil {
+					return nil, err
+				}
+			}
+			changes = append(changes, FileChange{p, "conflict"})
+		}
+	}
+
+	if l.Files != nil {
+		files := make(map[string]string)
+		for p, t := range theirFiles {
+			files[p] = digestOf(t)
+		}
+		l.Files = files
+	}
+	l.Version = target.Version
+	l.Digest = target.Digest
+	if l.Data, l.Redacted, err = redactSecrets(data, l.Redacted); err != nil {
+		return nil, err
+	}
+	if err := writeLockFile(dir, l); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func sameFile(exists1 bool, content1 []byte, exists2 bool, content2 []byte) bool {
+	return exists1 == exists2 && bytes.Equal(content1, content2)
+}
+
+// writeFile writes the file with the mode, creating its directory.
+func writeFile(fp string, content []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	return writeFileMode(fp, content, mode)
+}
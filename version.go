@@ -0,0 +1,210 @@
+package fstash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Version is a snapshot of the files of a stash. The content of the
+// files is kept in the blob store, by digest.
+type Version struct {
+	Version   string            `json:"version"`
+	Digest    string            `json:"digest"`
+	Created   time.Time         `json:"created"`
+	Templates []string          `json:"templates,omitempty"`
+	Files     map[string]string `json:"files"`
+	// Links are the symlinks of the stash, by path, with their targets
+	Links map[string]string `json:"links,omitempty"`
+	// Modes are the permissions of the files, by path; versions made before
+	// they were recorded have none
+	Modes map[string]os.FileMode `json:"modes,omitempty"`
+}
+
+func (m *Manifest) findVersion(version string) *Version {
+	for i := range m.Versions {
+		if m.Versions[i].Version == version {
+			return &m.Versions[i]
+		}
+	}
+	return nil
+}
+
+// nextVersion is the number of versions plus one, skipping the ones already
+// taken by explicitly named versions.
+func (m *Manifest) nextVersion() string {
+	n := len(m.Versions) + 1
+	for m.findVersion(strconv.Itoa(n)) != nil {
+		n++
+	}
+	return strconv.Itoa(n)
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// filesDigest is the digest of a whole version, computed from its paths and
+// the digests of their content, and the targets of its symlinks.
+func filesDigest(files, links map[string]string) string {
+	var paths []string
+	for k := range files {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "%s\x00%s\n", p, files[p])
+	}
+	paths = paths[:0]
+	for k := range links {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(h, "%s\x00->%s\n", p, links[p])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func blobPath(fstashHome, digest string) string {
+	return filepath.Join(fstashHome, "blobs", digest[:2], digest)
+}
+
+// blobKey is the key of a blob in a store.
+func blobKey(digest string) string {
+	return path.Join(archiveBlobs, digest)
+}
+
+func putBlob(store Store, content []byte) (string, error) {
+	digest := digestOf(content)
+	if hasBlob(store, digest) {
+		return digest, nil
+	}
+	return digest, store.Put(blobKey(digest), content, 0644)
+}
+
+func getBlob(store Store, digest string) ([]byte, error) {
+	if !validDigest(digest) {
+		return nil, ErrBlobNotExist
+	}
+	content, _, err := store.Get(blobKey(digest))
+	if err == ErrKeyNotExist {
+		return nil, ErrBlobNotExist
+	}
+	return content, err
+}
+
+// hasBlob tells whether the blob of the digest is in the store.
+func hasBlob(store Store, digest string) bool {
+	if !validDigest(digest) {
+		return false
+	}
+	_, err := store.Stat(blobKey(digest))
+	return err == nil
+}
+
+// snapshotStash records the current content of the stash as a new version.
+// An empty version gets the next number.
+func snapshotStash(store Store, m *Manifest, version string) error {
+	content, err := readContent(store, m.Name)
+	if err != nil {
+		return err
+	}
+	return snapshotContent(store, content, m, version)
+}
+
+// snapshotContent is snapshotStash recording content, instead of the
+// current content of the stash.
+func snapshotContent(store Store, content map[string]*archiveEntry, m *Manifest, version string) error {
+	if version == "" {
+		version = m.nextVersion()
+	}
+	if !validateVersion(version) {
+		return ErrInvalidVersion
+	}
+	if m.findVersion(version) != nil {
+		return ErrVersionExists
+	}
+	v, err := storeContent(store, content)
+	if err != nil {
+		return err
+	}
+	v.Version = version
+	v.Created = time.Now().UTC()
+	v.Templates = m.Templates
+	m.Versions = append(m.Versions, *v)
+	m.Version = version
+	return nil
+}
+
+// storeContent puts the content of all files into the blob store and returns
+// a version holding their digests and modes by path, and the digest of them
+// all. Symlinks are never read through; their targets are kept by path
+// instead.
+func storeContent(store Store, content map[string]*archiveEntry) (*Version, error) {
+	v := &Version{Files: make(map[string]string), Modes: make(map[string]os.FileMode)}
+	for rel, entry := range content {
+		if entry.isLink() {
+			if v.Links == nil {
+				v.Links = make(map[string]string)
+			}
+			v.Links[rel] = filepath.ToSlash(entry.link)
+			continue
+		}
+		digest, err := putBlob(store, entry.content)
+		if err != nil {
+			return nil, err
+		}
+		v.Files[rel] = digest
+		v.Modes[rel] = entry.perm()
+	}
+	v.Digest = filesDigest(v.Files, v.Links)
+	return v, nil
+}
+
+// fileMode returns the mode of a file of the version, or 0644 when the
+// version has none recorded for it.
+func (v *Version) fileMode(rel string) os.FileMode {
+	if mode, ok := v.Modes[rel]; ok && mode.Perm() != 0 {
+		return mode.Perm()
+	}
+	return 0644
+}
+
+// renderVersion returns the files of a version of the stash of m, by their
+// expanded paths, as they would be expanded with the data.
+func renderVersion(store Store, m *Manifest, v *Version, templatesData map[string]string) (map[string][]byte, error) {
+	m = &Manifest{Templates: v.Templates, DataTemplates: m.DataTemplates}
+	files := make(map[string][]byte)
+	for rel, digest := range v.Files {
+		content, err := getBlob(store, digest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+		rel, content, err := renderFile(rel, content, m, templatesData)
+		if err != nil {
+			return nil, err
+		}
+		files[rel] = content
+	}
+	return files, nil
+}
+
+// validDigest reports whether digest looks like a sha256 hex digest, so it
+// is safe to use as a path in the blob store.
+func validDigest(digest string) bool {
+	return regexp.MustCompile("^[a-f0-9]{64}$").MatchString(digest)
+}
+
+func validateVersion(version string) bool {
+	return regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9.+_-]*$").MatchString(version)
+}